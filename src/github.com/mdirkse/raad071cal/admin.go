@@ -0,0 +1,186 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminToken protects the /admin endpoints. Without a token they are disabled.
+var adminToken string
+
+// adminStatus is the detailed status of a tenant.
+type adminStatus struct {
+	LastPoll    pollStatus `json:"lastPoll"`
+	Duration    string     `json:"duration"`
+	Items       int        `json:"items"` // in the feed
+	Refreshing  bool       `json:"refreshing"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// startRefresh polls the tenant in the background, unless a poll is already running. It reports
+// whether it started a poll, and returns a channel that is closed when the running poll is done.
+func (t *tenant) startRefresh(ctx context.Context) (bool, <-chan struct{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.refreshing != nil {
+		return false, t.refreshing
+	}
+
+	running := make(chan struct{})
+	t.refreshing = running
+
+	go func() {
+		defer func() {
+			t.mutex.Lock()
+			t.refreshing = nil
+			t.mutex.Unlock()
+			close(running)
+		}()
+
+		loadCalendarItems(ctx, t)
+	}()
+
+	return true, running
+}
+
+// refresh polls the tenant, or waits for the poll that is already running.
+func (t *tenant) refresh(ctx context.Context) {
+	_, done := t.startRefresh(ctx)
+	<-done
+}
+
+// waitForRefresh waits until the running poll, if any, is done or ctx is.
+func (t *tenant) waitForRefresh(ctx context.Context) {
+	t.mutex.RLock()
+	running := t.refreshing
+	t.mutex.RUnlock()
+
+	if running == nil {
+		return
+	}
+	select {
+	case <-running:
+	case <-ctx.Done():
+	}
+}
+
+func (t *tenant) setLastError(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lastError = err.Error()
+	t.lastErrorAt = time.Now()
+}
+
+func (t *tenant) adminStatus() adminStatus {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	as := adminStatus{
+		LastPoll:   t.status,
+		Items:      len(t.calItems()),
+		Refreshing: t.refreshing != nil,
+		LastError:  t.lastError,
+	}
+	if !t.lastErrorAt.IsZero() {
+		at := t.lastErrorAt
+		as.LastErrorAt = &at
+	}
+	if !t.status.Finished.IsZero() {
+		as.Duration = t.status.Finished.Sub(t.status.Started).String()
+	}
+
+	return as
+}
+
+// adminHandler only lets requests with the admin token through.
+func adminHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="raad071cal"`)
+			http.Error(w, "Unauthorized!", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// refreshHandler starts a poll of all tenants, or of the one in ?gemeente=, in the background.
+// Tenants that are already being polled are not polled again. The polls run with ctx rather than
+// the context of the request.
+func refreshHandler(ctx context.Context, ts []*tenant) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Use POST to refresh!", http.StatusMethodNotAllowed)
+			return
+		}
+
+		selected := ts
+		if name := r.URL.Query().Get("gemeente"); name != "" {
+			selected = nil
+			for _, t := range ts {
+				if t.Name == name {
+					selected = append(selected, t)
+				}
+			}
+			if len(selected) == 0 {
+				http.Error(w, fmt.Sprintf("Unknown gemeente [%s]!", name), http.StatusNotFound)
+				return
+			}
+		}
+
+		result := make(map[string]string, len(selected))
+		for _, t := range selected {
+			if started, _ := t.startRefresh(ctx); !started {
+				result[t.Name] = "running"
+				continue
+			}
+			result[t.Name] = "started"
+			logger(r.Context()).Info("Refresh requested", "gemeente", t.Name, "remote", r.RemoteAddr)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			logger(r.Context()).Error("Unable to write the refresh result", "err", err)
+		}
+	})
+}
+
+// adminStatusHandler shows the detailed status of every tenant.
+func adminStatusHandler(ts []*tenant) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string]adminStatus, len(ts))
+		for _, t := range ts {
+			status[t.Name] = t.adminStatus()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			logger(r.Context()).Error("Unable to write the admin status", "err", err)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func adminRequest(h http.Handler, method string, url string, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	adminHandler(h).ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminEndpointsShouldRequireTheToken(t *testing.T) {
+	defer func(at string) { adminToken = at }(adminToken)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	adminToken = ""
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(ok, "GET", "/admin/status", "").Code, "Admin endpoint without a token was accessible!")
+
+	adminToken = "geheim"
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(ok, "GET", "/admin/status", "").Code, "Request without a token was allowed!")
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(ok, "GET", "/admin/status", "fout").Code, "Request with a wrong token was allowed!")
+	assert.Equal(t, http.StatusOK, adminRequest(ok, "GET", "/admin/status", "geheim").Code, "Request with the token was refused!")
+}
+
+func TestRefreshShouldBeDeduplicated(t *testing.T) {
+	defer func(at string) { adminToken = at }(adminToken)
+	adminToken = "geheim"
+	store = newMemoryStore()
+
+	var requests int32
+	release := make(chan bool)
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		io.WriteString(w, `callback_function({"success": true, "meetings": []})`)
+	})
+	defer srv.Close()
+	h := refreshHandler(context.Background(), []*tenant{tt})
+
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(h, "GET", "/admin/refresh", "geheim").Code, "Refresh with GET was allowed!")
+	assert.Equal(t, http.StatusNotFound, adminRequest(h, "POST", "/admin/refresh?gemeente=utrecht", "geheim").Code, "Unknown tenant was refreshed!")
+
+	first := adminRequest(h, "POST", "/admin/refresh", "geheim")
+	second := adminRequest(h, "POST", "/admin/refresh?gemeente=leiden", "geheim")
+
+	assert.Equal(t, http.StatusAccepted, first.Code, "Refresh was not accepted!")
+	assert.JSONEq(t, `{"leiden": "started"}`, first.Body.String(), "Refresh was not started!")
+	assert.JSONEq(t, `{"leiden": "running"}`, second.Body.String(), "Concurrent refresh was not deduplicated!")
+
+	// A poll that joins the running one returns when that one is done
+	close(release)
+	tt.refresh(context.Background())
+
+	assert.Equal(t, int32(generatedMonths), atomic.LoadInt32(&requests), "Tenant was polled more than once!")
+	assert.Equal(t, generatedMonths, len(tt.pollStatus().Months), "Poll status not updated!")
+
+	status := adminRequest(adminStatusHandler([]*tenant{tt}), "GET", "/admin/status", "geheim")
+	assert.NotContains(t, status.Body.String(), "lastError", "Tenant without errors has a last error!")
+}
+
+func TestAdminStatusShouldShowTheLastError(t *testing.T) {
+	defer func(at string) { adminToken = at }(adminToken)
+	adminToken = "geheim"
+	store = newMemoryStore()
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		http.Error(w, "Eep!", http.StatusForbidden)
+	})
+	defer srv.Close()
+	tt.refresh(context.Background())
+
+	w := adminRequest(adminStatusHandler([]*tenant{tt}), "GET", "/admin/status", "geheim")
+
+	var status map[string]adminStatus
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+
+	assert.Nil(t, err, "Admin status is not valid JSON!")
+	s := status["leiden"]
+	assert.True(t, s.LastPoll.Abandoned, "Failed poll not in the status!")
+	assert.Equal(t, generatedMonths, len(s.LastPoll.Months), "Months missing from the status!")
+	assert.NotEmpty(t, s.Duration, "Poll duration missing!")
+	assert.Contains(t, s.LastError, "403 Forbidden", "Last error missing!")
+	assert.NotNil(t, s.LastErrorAt, "Time of the last error missing!")
+	assert.False(t, s.Refreshing, "Tenant is still refreshing!")
+}
@@ -0,0 +1,355 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPrefix         = "/api/v1/"
+	apiMeetingsPath   = apiPrefix + "meetings"
+	apiOpenAPIPath    = apiPrefix + "openapi.json"
+	apiDefaultPerPage = 50
+	apiMaxPerPage     = 200
+)
+
+// apiMeeting is a meeting as it is returned by the API. It is part of the documented schema (see
+// openAPISpec), so fields may be added but never changed or removed within v1.
+type apiMeeting struct {
+	ID        string        `json:"id"`
+	Gemeente  string        `json:"gemeente"`
+	Title     string        `json:"title"`
+	Start     time.Time     `json:"start"`
+	End       time.Time     `json:"end"`
+	AllDay    bool          `json:"allDay"`
+	Canceled  bool          `json:"canceled"`
+	Removed   bool          `json:"removed"`
+	Location  string        `json:"location,omitempty"`
+	Committee *apiCommittee `json:"committee,omitempty"`
+	Documents []apiDocument `json:"documents"`
+	Revision  int           `json:"revision"`
+	Updated   time.Time     `json:"updated"`
+	Links     apiLinks      `json:"links"`
+}
+
+type apiCommittee struct {
+	Short string `json:"short"`
+	Name  string `json:"name"`
+}
+
+type apiDocument struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type apiLinks struct {
+	Self     string `json:"self"`
+	Calendar string `json:"calendar"`
+	Page     string `json:"page"`
+	Notubiz  string `json:"notubiz,omitempty"`
+}
+
+// apiMeetingList is a page of meetings.
+type apiMeetingList struct {
+	Meetings []apiMeeting `json:"meetings"`
+	Page     int          `json:"page"`
+	PerPage  int          `json:"perPage"`
+	Total    int          `json:"total"`
+	Next     string       `json:"next,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// newAPIMeeting converts a meeting of the tenant to its API representation. All-day meetings
+// run from the start of their day until the start of the next day.
+func newAPIMeeting(t *tenant, i CalItem) apiMeeting {
+	start, end := i.StartDateTime.In(cestTz), i.EndDateTime.In(cestTz)
+	if i.AllDay {
+		s := i.StartDateTime.In(time.UTC)
+		start = time.Date(s.Year(), s.Month(), s.Day(), 0, 0, 0, 0, cestTz)
+		end = start.AddDate(0, 0, 1)
+	}
+
+	m := apiMeeting{
+		ID:        i.UID,
+		Gemeente:  t.Name,
+		Title:     i.Description,
+		Start:     start,
+		End:       end,
+		AllDay:    i.AllDay,
+		Canceled:  i.Canceled,
+		Removed:   i.Removed,
+		Location:  i.Location,
+		Documents: []apiDocument{},
+		Revision:  i.Sequence,
+		Updated:   i.LastModified.In(time.UTC),
+		Links: apiLinks{
+			Self:     apiMeetingsPath + "/" + i.UID,
+			Calendar: eventPrefix + i.UID + ".ics",
+			Page:     meetingPrefix + i.UID,
+			Notubiz:  i.Link,
+		},
+	}
+
+	if i.Committee.ID != 0 {
+		m.Committee = &apiCommittee{Short: i.Committee.Short, Name: i.Committee.Long}
+	}
+	for _, d := range i.ExtractedDocuments {
+		m.Documents = append(m.Documents, apiDocument{Title: d.Title, URL: d.URL})
+	}
+
+	return m
+}
+
+// meetingQuery is a request for a page of meetings, eg.
+// ?gemeente=leiden&from=2026-01-01&to=2026-06-30&committee=os,so&q=begroting&page=2&per_page=20
+type meetingQuery struct {
+	tenants    []*tenant
+	filter     itemFilter // from, to and q
+	committees []string
+	page       int
+	perPage    int
+}
+
+// parseMeetingQuery reads the query parameters of a meeting list request. Without a date range
+// the meetings in the feed window are returned.
+func parseMeetingQuery(ts []*tenant, v url.Values, now time.Time) (meetingQuery, error) {
+	q := meetingQuery{tenants: ts, page: 1, perPage: apiDefaultPerPage}
+	filterValues := url.Values{}
+
+	// Go through the parameters in a fixed order so the errors are predictable
+	names := make([]string, 0, len(v))
+	for n := range v {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		vs := v[n]
+		if len(vs) > 1 {
+			return q, fmt.Errorf("Parameter [%s] may only be specified once!", n)
+		}
+
+		switch n {
+		case "from", "to", "q":
+			filterValues.Set(n, vs[0])
+		case "committee":
+			q.committees = splitFilterList(vs[0])
+		case "gemeente":
+			q.tenants = nil
+			for _, name := range splitFilterList(vs[0]) {
+				t := findTenant(ts, name)
+				if t == nil {
+					return q, fmt.Errorf("Unknown gemeente [%s]!", name)
+				}
+				q.tenants = append(q.tenants, t)
+			}
+		case "page", "per_page":
+			p, err := strconv.Atoi(vs[0])
+			if err != nil || p < 1 {
+				return q, fmt.Errorf("Parameter [%s] must be a positive number, not [%s]!", n, vs[0])
+			}
+			if n == "per_page" && p > apiMaxPerPage {
+				return q, fmt.Errorf("Parameter [per_page] may not be larger than %d!", apiMaxPerPage)
+			}
+			if n == "page" {
+				q.page = p
+			} else {
+				q.perPage = p
+			}
+		default:
+			return q, fmt.Errorf("Unknown parameter [%s]! Supported parameters are: committee, from, gemeente, page, per_page, q, to.", n)
+		}
+	}
+
+	f, err := parseItemFilter(filterValues)
+	if err != nil {
+		return q, err
+	}
+	if f.from.IsZero() && f.to.IsZero() {
+		f.from, f.to = feedWindow(now)
+	}
+	q.filter = f
+
+	return q, nil
+}
+
+func findTenant(ts []*tenant, name string) *tenant {
+	for _, t := range ts {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// meetings returns every meeting that matches the query, ordered by start time. The meetings
+// are read from the store, so the date range can go back further than the feeds.
+func (q meetingQuery) meetings() ([]apiMeeting, error) {
+	from, to := q.filter.from, q.filter.to
+	if from.IsZero() {
+		from = time.Unix(0, 0)
+	}
+	if to.IsZero() {
+		to = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+	}
+
+	var ms []apiMeeting
+	for _, t := range q.tenants {
+		items, err := store.Range(t.Name, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range items {
+			if !feedFilter.matches(i) || !q.filter.matches(i) {
+				continue
+			}
+			if len(q.committees) > 0 && (i.Committee.ID == 0 || !contains(q.committees, strings.ToLower(i.Committee.Short))) {
+				continue
+			}
+			ms = append(ms, newAPIMeeting(t, i))
+		}
+	}
+
+	sort.SliceStable(ms, func(a, b int) bool {
+		if !ms[a].Start.Equal(ms[b].Start) {
+			return ms[a].Start.Before(ms[b].Start)
+		}
+		return ms[a].ID < ms[b].ID
+	})
+
+	return ms, nil
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// meetingsHandler serves pages of meetings on /api/v1/meetings and single meetings on
+// /api/v1/meetings/{id}.
+func meetingsHandler(ts []*tenant) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uid := strings.TrimPrefix(r.URL.Path, apiMeetingsPath); uid != r.URL.Path && uid != "" && uid != "/" {
+			serveAPIMeeting(w, r, ts, strings.TrimPrefix(uid, "/"))
+			return
+		}
+
+		q, err := parseMeetingQuery(ts, r.URL.Query(), time.Now())
+		if err != nil {
+			writeAPI(w, r, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		if !allLoaded(q.tenants) {
+			writeNotLoaded(w, r)
+			return
+		}
+
+		ms, err := q.meetings()
+		if err != nil {
+			logger(r.Context()).Error("Unable to read the meetings", "err", err)
+			writeAPI(w, r, http.StatusInternalServerError, apiError{"Couldn't read the meetings!"})
+			return
+		}
+
+		l := apiMeetingList{Meetings: []apiMeeting{}, Page: q.page, PerPage: q.perPage, Total: len(ms)}
+		if start := (q.page - 1) * q.perPage; start < len(ms) {
+			end := start + q.perPage
+			if end < len(ms) {
+				next := r.URL.Query()
+				next.Set("page", strconv.Itoa(q.page+1))
+				l.Next = apiMeetingsPath + "?" + next.Encode()
+			} else {
+				end = len(ms)
+			}
+			l.Meetings = ms[start:end]
+		}
+
+		writeAPI(w, r, http.StatusOK, l)
+	})
+}
+
+func serveAPIMeeting(w http.ResponseWriter, r *http.Request, ts []*tenant, uid string) {
+	if strings.Contains(uid, "/") {
+		writeAPI(w, r, http.StatusNotFound, apiError{"Meeting not found!"})
+		return
+	}
+
+	t, i, ok, err := findItem(ts, uid)
+	if err != nil {
+		logger(r.Context()).Error("Unable to look up the meeting", "uid", uid, "err", err)
+		writeAPI(w, r, http.StatusInternalServerError, apiError{"Couldn't read the meeting!"})
+		return
+	}
+	if !ok && !allLoaded(ts) {
+		writeNotLoaded(w, r)
+		return
+	}
+	if !ok {
+		writeAPI(w, r, http.StatusNotFound, apiError{"Meeting not found!"})
+		return
+	}
+
+	writeAPI(w, r, http.StatusOK, newAPIMeeting(t, i))
+}
+
+// openAPIHandler serves the description of the API.
+func openAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte(openAPISpec))
+	})
+}
+
+// allLoaded reports whether all the tenants have data. Until then, the API would answer with
+// an empty list or a 404 for meetings that do exist.
+func allLoaded(ts []*tenant) bool {
+	for _, t := range ts {
+		if !t.isLoaded() {
+			return false
+		}
+	}
+	return true
+}
+
+func writeNotLoaded(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(notLoadedRetryAfter.Seconds())))
+	writeAPI(w, r, http.StatusServiceUnavailable, apiError{"The meetings haven't been loaded yet, please try again later."})
+}
+
+func writeAPI(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger(r.Context()).Error("Unable to write the API response", "path", r.URL.Path, "err", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testMeetingsPath = apiMeetingsPath + "?from=2016-06-01&to=2016-06-30"
+
+func getMeetingList(t *testing.T, h http.Handler, path string) apiMeetingList {
+	w := lookupRequest(h, path)
+	assert.Equal(t, http.StatusOK, w.Code, "Request for [%s] failed: %s", path, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "Wrong content type!")
+
+	var l apiMeetingList
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &l), "Meeting list is not valid JSON!")
+	return l
+}
+
+func meetingIDs(l apiMeetingList) []string {
+	ids := []string{}
+	for _, m := range l.Meetings {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestMeetingsShouldBeListedByStartTime(t *testing.T) {
+	h := meetingsHandler(storeTestItems())
+
+	l := getMeetingList(t, h, testMeetingsPath)
+
+	assert.Equal(t, []string{"leiden-247977", "leiden-247981", "leiden-247980"}, meetingIDs(l), "Wrong meetings!")
+	assert.Equal(t, 3, l.Total, "Wrong total!")
+	assert.Empty(t, l.Next, "Single page has a next page!")
+}
+
+func TestMeetingsShouldBeFiltered(t *testing.T) {
+	h := meetingsHandler(storeTestItems())
+
+	for path, expected := range map[string][]string{
+		testMeetingsPath + "&committee=so":         {"leiden-247980"},
+		testMeetingsPath + "&committee=OS,so":      {"leiden-247981", "leiden-247980"},
+		testMeetingsPath + "&q=raad071cal":         {"leiden-247981"},
+		testMeetingsPath + "&gemeente=oegstgeest":  {},
+		apiMeetingsPath + "?from=2016-06-24":       {},
+		apiMeetingsPath + "?to=2016-06-22":         {},
+		apiMeetingsPath + "?gemeente=leiden":       {}, // outside the feed window
+		testMeetingsPath + "&gemeente=leiden&q=zo": {"leiden-247977"},
+	} {
+		assert.Equal(t, expected, meetingIDs(getMeetingList(t, h, path)), "Wrong meetings for [%s]!", path)
+	}
+}
+
+func TestMeetingsShouldBePaged(t *testing.T) {
+	h := meetingsHandler(storeTestItems())
+
+	l := getMeetingList(t, h, testMeetingsPath+"&per_page=2")
+	assert.Equal(t, []string{"leiden-247977", "leiden-247981"}, meetingIDs(l), "Wrong first page!")
+	assert.Equal(t, 3, l.Total, "Wrong total!")
+	assert.Equal(t, apiMeetingsPath+"?from=2016-06-01&page=2&per_page=2&to=2016-06-30", l.Next, "Wrong next page!")
+
+	l = getMeetingList(t, h, l.Next)
+	assert.Equal(t, []string{"leiden-247980"}, meetingIDs(l), "Wrong second page!")
+	assert.Equal(t, 2, l.Page, "Wrong page!")
+	assert.Empty(t, l.Next, "Last page has a next page!")
+
+	assert.Empty(t, getMeetingList(t, h, testMeetingsPath+"&page=3").Meetings, "Page after the last page has meetings!")
+}
+
+func TestInvalidMeetingQueriesShouldBeRejected(t *testing.T) {
+	h := meetingsHandler(storeTestItems())
+
+	for _, q := range []string{"?bla=1", "?page=0", "?per_page=201", "?from=gisteren", "?gemeente=amsterdam", "?q=a&q=b"} {
+		w := lookupRequest(h, apiMeetingsPath+q)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "[%s] was accepted!", q)
+
+		var e apiError
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &e), "Error is not valid JSON!")
+		assert.NotEmpty(t, e.Error, "Error has no message!")
+	}
+}
+
+func TestMeetingsShouldBeUnavailableUntilLoaded(t *testing.T) {
+	ts := storeTestItems()
+	ts[0] = newTenant("oegstgeest") // not loaded
+	h := meetingsHandler(ts)
+
+	for _, p := range []string{testMeetingsPath, testMeetingsPath + "&gemeente=oegstgeest", apiMeetingsPath + "/leiden-1"} {
+		w := lookupRequest(h, p)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, "[%s] served before loading!", p)
+		assert.Equal(t, "30", w.Header().Get("Retry-After"), "Retry-After missing for [%s]!", p)
+	}
+
+	// Meetings of the loaded tenant, and meetings that are found, are served
+	getMeetingList(t, h, testMeetingsPath+"&gemeente=leiden")
+	assert.Equal(t, http.StatusOK, lookupRequest(h, apiMeetingsPath+"/leiden-247980").Code, "Found meeting not served!")
+}
+
+func TestSingleMeetingShouldHaveAllDetails(t *testing.T) {
+	h := meetingsHandler(storeTestItems())
+	i := GetTestItem3()
+
+	w := lookupRequest(h, apiMeetingsPath+"/"+i.UID)
+	assert.Equal(t, http.StatusOK, w.Code, "Meeting not found!")
+
+	var m apiMeeting
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &m), "Meeting is not valid JSON!")
+	assert.Equal(t, "leiden", m.Gemeente, "Wrong gemeente!")
+	assert.Equal(t, i.Description, m.Title, "Wrong title!")
+	assert.True(t, m.Start.Equal(i.StartDateTime), "Wrong start!")
+	assert.True(t, m.End.Equal(i.EndDateTime), "Wrong end!")
+	assert.Equal(t, &apiCommittee{"SO", "raadscommissie Stedelijke Ontwikkeling"}, m.Committee, "Wrong committee!")
+	assert.Equal(t, []apiDocument{{"Agenda", "https://leiden.notubiz.nl/document/1"}}, m.Documents, "Wrong documents!")
+	assert.Equal(t, apiLinks{
+		Self:     "/api/v1/meetings/leiden-247980",
+		Calendar: "/kalender/event/leiden-247980.ics",
+		Page:     "/vergadering/leiden-247980",
+		Notubiz:  i.Link,
+	}, m.Links, "Wrong links!")
+	assert.Contains(t, w.Body.String(), `"start":"2016-06-23T20:00:00+02:00"`, "Start not in local time!")
+
+	for _, uid := range []string{"leiden-1", "a/" + i.UID} {
+		w = lookupRequest(h, apiMeetingsPath+"/"+uid)
+		assert.Equal(t, http.StatusNotFound, w.Code, "[%s] was found!", uid)
+	}
+}
+
+func TestAllDayMeetingsShouldLastTheWholeDay(t *testing.T) {
+	m := newAPIMeeting(GetTestTenant(), GetTestItem1())
+
+	assert.Equal(t, time.Date(2016, time.June, 23, 0, 0, 0, 0, cestTz), m.Start, "Wrong start!")
+	assert.Equal(t, time.Date(2016, time.June, 24, 0, 0, 0, 0, cestTz), m.End, "Wrong end!")
+	assert.Nil(t, m.Committee, "Meeting without a committee has one!")
+	assert.Equal(t, []apiDocument{}, m.Documents, "Documents should be an empty list!")
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backfillSuffix    = ".backfill"
+	firstArchiveYear  = 1990
+	archiveYearsAhead = 5
+)
+
+// runBackfill implements the backfill subcommand, which imports a range of (past) months into
+// the store. Progress is recorded per tenant and range, so an interrupted backfill of the same
+// range continues where it left off.
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	fromS := fs.String("from", "2010-01", "First month to import (YYYY-MM).")
+	toS := fs.String("to", time.Now().Format(monthLayout), "Last month to import (YYYY-MM).")
+	throttle := fs.Duration("throttle", 2*time.Second, "Time to wait between two requests to Notubiz.")
+	restart := fs.Bool("restart", false, "Ignore earlier progress and start at the first month again.")
+
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if cfg.DataDir == "" {
+		return errors.New("A data directory is required for a backfill!")
+	}
+	cfg.apply()
+
+	from, err := parseMonth(*fromS)
+	if err != nil {
+		return err
+	}
+	to, err := parseMonth(*toS)
+	if err != nil {
+		return err
+	}
+	if to.before(from) {
+		return fmt.Errorf("Month [%s] is before month [%s]!", *toS, *fromS)
+	}
+
+	ts, err := cfg.tenants()
+	if err != nil {
+		return err
+	}
+
+	s, err := openBoltStore(cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	for _, t := range ts {
+		progress := filepath.Join(cfg.DataDir, t.Name+backfillSuffix)
+		if *restart {
+			os.Remove(progress)
+		}
+
+		if err := backfillTenant(context.Background(), t, s, from, to, progress, *throttle); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func backfillTenant(ctx context.Context, t *tenant, s Store, from yearMonth, to yearMonth, progress string, throttle time.Duration) error {
+	start := from
+	if done, ok := readBackfillProgress(progress, from, to); ok {
+		if done == to {
+			slog.Info("Backfill range already complete, use -restart to import it again", "gemeente", t.Name, "from", from.String(), "to", to.String())
+			return nil
+		}
+
+		start = done.next()
+		slog.Info("Resuming backfill", "gemeente", t.Name, "after", done.String())
+	}
+
+	for ym := start; !to.before(ym); ym = ym.next() {
+		now := time.Now()
+		r := fetchMonth(ctx, t, ym, now)
+		if r.err != nil {
+			return fmt.Errorf("Backfill of [%s] stopped at [%s]: %+v", t.Name, ym, r.err)
+		}
+
+		if _, err := s.Replace(t.Name, r.replacedMonths(), r.items, now); err != nil {
+			return fmt.Errorf("Backfill of [%s] stopped at [%s]: %+v", t.Name, ym, err)
+		}
+
+		if err := writeBackfillProgress(progress, from, to, ym); err != nil {
+			return fmt.Errorf("Unable to record backfill progress of [%s]: %+v", t.Name, err)
+		}
+
+		slog.Info("Backfilled month", "gemeente", t.Name, "month", ym.String(), "items", len(r.items))
+
+		if ym != to {
+			select {
+			case <-time.After(throttle):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeBackfillProgress records that the months of [from, to] up to and including done are imported.
+func writeBackfillProgress(progress string, from yearMonth, to yearMonth, done yearMonth) error {
+	return ioutil.WriteFile(progress, []byte(fmt.Sprintf("%s %s %s", from, to, done)), 0644)
+}
+
+// readBackfillProgress returns the last imported month of an earlier backfill of [from, to].
+// Progress of a backfill of another range is ignored, as it says nothing about this one.
+func readBackfillProgress(progress string, from yearMonth, to yearMonth) (yearMonth, bool) {
+	data, err := ioutil.ReadFile(progress)
+	if err != nil {
+		return yearMonth{}, false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		slog.Warn("Ignoring unreadable backfill progress", "file", progress)
+		return yearMonth{}, false
+	}
+	if fields[0] != from.String() || fields[1] != to.String() {
+		slog.Info("Ignoring backfill progress of another range", "file", progress, "from", fields[0], "to", fields[1])
+		return yearMonth{}, false
+	}
+
+	ym, err := parseMonth(fields[2])
+	if err != nil || ym.before(from) || to.before(ym) {
+		slog.Warn("Ignoring unreadable backfill progress", "file", progress, "err", err)
+		return yearMonth{}, false
+	}
+
+	return ym, true
+}
+
+func (t *tenant) archiveFeed(year int) feed {
+	return feed{
+		URL:         fmt.Sprintf("%s/%s/archief/%d.ics", feedURLPrefix, t.Name, year),
+		Name:        fmt.Sprintf("%s - archief %d", t.CalName, year),
+		Description: fmt.Sprintf("%s in %d", t.CalDesc, year),
+	}
+}
+
+// archiveHandler serves all stored meetings of a year on {prefix}{year}.ics.
+func archiveHandler(t *tenant, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+
+		year, err := strconv.Atoi(strings.TrimSuffix(name, ".ics"))
+		if err != nil || !strings.HasSuffix(name, ".ics") || year < firstArchiveYear || year > time.Now().Year()+archiveYearsAhead {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The store only changes during a poll, which publishes a new snapshot afterwards
+		t.serveFeed(w, r, t.snapshot(), "archief/"+name, "text/calendar", func(w io.Writer) error {
+			items, err := store.Range(t.Name, time.Date(year, time.January, 1, 0, 0, 0, 0, cestTz), time.Date(year+1, time.January, 1, 0, 0, 0, 0, cestTz))
+			if err != nil {
+				return fmt.Errorf("Unable to read the archive of [%d]: %w", year, err)
+			}
+
+			return renderCalendar(t.archiveFeed(year), feedFilter.apply(dropRemoved(items)), w)
+		})
+	})
+}
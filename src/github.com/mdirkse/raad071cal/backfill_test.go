@@ -0,0 +1,122 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackfillShouldImportAndResume(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raad071cal")
+	defer os.RemoveAll(dir)
+	progress := filepath.Join(dir, "leiden"+backfillSuffix)
+
+	serve := serveTestFile("../../../../testfiles/tst.json")
+	var fetched []yearMonth
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		fetched = append(fetched, ym)
+		if ym.month == 8 {
+			http.NotFound(w, r)
+			return
+		}
+		serve(w, r, ym)
+	})
+	defer srv.Close()
+
+	s, _ := openBoltStore(dir)
+
+	// The fetch of the 8th month fails, so the backfill stops after the 7th
+	err := backfillTenant(context.Background(), tt, s, yearMonth{2016, 5}, yearMonth{2016, 9}, progress, 0)
+	assert.NotNil(t, err, "Failing backfill did not result in an error!")
+	assert.Equal(t, 4, len(fetched), "Wrong amount of months fetched!")
+
+	done, ok := readBackfillProgress(progress, yearMonth{2016, 5}, yearMonth{2016, 9})
+	assert.True(t, ok, "No progress recorded!")
+	assert.Equal(t, yearMonth{2016, 7}, done, "Wrong progress recorded!")
+
+	from, to := getAllTime()
+	items, _ := s.Range("leiden", from, to)
+	assert.Equal(t, 3, len(items), "Backfilled items not stored!")
+
+	// Resuming starts at the failed month
+	fetched = nil
+	backfillTenant(context.Background(), tt, s, yearMonth{2016, 5}, yearMonth{2016, 9}, progress, 0)
+	if assert.NotEmpty(t, fetched, "Nothing fetched on resume!") {
+		assert.Equal(t, yearMonth{2016, 8}, fetched[0], "Backfill did not resume at the right month!")
+	}
+}
+
+func TestBackfillShouldOnlyResumeTheSameRange(t *testing.T) {
+	dir := t.TempDir()
+	progress := filepath.Join(dir, "leiden"+backfillSuffix)
+
+	var fetched []yearMonth
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		fetched = append(fetched, ym)
+		serveTestFile("../../../../testfiles/tst.json")(w, r, ym)
+	})
+	defer srv.Close()
+
+	s, _ := openBoltStore(dir)
+	defer s.Close()
+
+	err := backfillTenant(context.Background(), tt, s, yearMonth{2016, 5}, yearMonth{2016, 6}, progress, 0)
+	assert.Nil(t, err, "Backfill failed!")
+
+	// The same range is complete, so nothing is fetched again
+	fetched = nil
+	backfillTenant(context.Background(), tt, s, yearMonth{2016, 5}, yearMonth{2016, 6}, progress, 0)
+	assert.Empty(t, fetched, "Complete range was fetched again!")
+
+	// A wider range doesn't skip the months before the earlier progress
+	backfillTenant(context.Background(), tt, s, yearMonth{2016, 3}, yearMonth{2016, 6}, progress, 0)
+	assert.Equal(t, []yearMonth{{2016, 3}, {2016, 4}, {2016, 5}, {2016, 6}}, fetched, "Wider range was not fetched completely!")
+}
+
+func TestArchiveEndpointShouldServeAYear(t *testing.T) {
+	store = newMemoryStore()
+	defer func() {
+		store = newMemoryStore()
+	}()
+	store.Replace("leiden", []yearMonth{testMonth}, []CalItem{GetTestItem1(), GetTestItem2()}, GetTestTime())
+
+	testSet := []struct {
+		path   string
+		status int
+		items  int
+	}{
+		{"2016.ics", 200, 2},
+		{"2015.ics", 200, 0},
+		{"2016", 404, 0},
+		{"zestien.ics", 404, 0},
+		{"1066.ics", 404, 0},
+	}
+
+	for _, ts := range testSet {
+		req, _ := http.NewRequest("GET", "/kalender/leiden/archief/"+ts.path, nil)
+		w := httptest.NewRecorder()
+		archiveHandler(GetTestTenant(), "/kalender/leiden/archief/").ServeHTTP(w, req)
+
+		assert.Equal(t, ts.status, w.Code, "Request for [%s] returned incorrect status!", ts.path)
+		assert.Equal(t, ts.items, strings.Count(w.Body.String(), "BEGIN:VEVENT"), "Request for [%s] returned wrong amount of items!", ts.path)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const storeFileName = "raad071cal.db"
+
+// Every tenant has a bucket with these buckets in it.
+var (
+	itemsBucket      = []byte("items")      // UID -> storedItem
+	startBucket      = []byte("start")      // start time + UID -> nothing, ordered by start time
+	validatorsBucket = []byte("validators") // month (YYYY-MM) -> monthValidator
+)
+
+// boltStore is a Store in a bbolt database in the data directory. Items are read from disk
+// when they are needed, and only the items that changed are written.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens the store in dir, creating it if needed. Only one process at a time can
+// have the store open.
+func openBoltStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create store directory [%s]: %+v", dir, err)
+	}
+
+	// bbolt locks the database file, so the service and a backfill can't write to the same
+	// data directory at the same time
+	path := filepath.Join(dir, storeFileName)
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("The store [%s] is in use by another process! Stop the service before running a backfill.", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the store [%s]: %+v", path, err)
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Replace(tenant string, months []yearMonth, items []CalItem, seen time.Time) ([]CalItem, error) {
+	var result []CalItem
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tenantBucket(tx, tenant)
+		if err != nil {
+			return err
+		}
+
+		put, removed, err := mergeMonths(months, items, seen,
+			func(uid string) (CalItem, bool, error) {
+				return getItem(b, uid)
+			},
+			func(ym yearMonth) ([]CalItem, error) {
+				from, to := monthRange(ym)
+				is, err := rangeItems(b, from, to)
+
+				// The range is a bit wider than the month for all-day items
+				var inMonth []CalItem
+				for _, i := range is {
+					if itemMonth(i) == ym {
+						inMonth = append(inMonth, i)
+					}
+				}
+				return inMonth, err
+			})
+		if err != nil {
+			return err
+		}
+
+		for _, i := range append(removed, put...) {
+			if err := putItem(b, i); err != nil {
+				return err
+			}
+		}
+
+		result = put
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to store the items of [%s]: %+v", tenant, err)
+	}
+
+	return result, nil
+}
+
+func (s *boltStore) Range(tenant string, from time.Time, to time.Time) ([]CalItem, error) {
+	items := []CalItem{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tenant))
+		if b == nil {
+			return nil
+		}
+
+		is, err := rangeItems(b, from, to)
+		items = append(items, is...)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the items of [%s]: %+v", tenant, err)
+	}
+
+	return items, nil
+}
+
+func (s *boltStore) Get(tenant string, uid string) (CalItem, bool, error) {
+	var i CalItem
+	var ok bool
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tenant))
+		if b == nil {
+			return nil
+		}
+
+		var err error
+		i, ok, err = getItem(b, uid)
+		return err
+	})
+	if err != nil {
+		return CalItem{}, false, fmt.Errorf("Unable to read item [%s] of [%s]: %+v", uid, tenant, err)
+	}
+
+	return i, ok, nil
+}
+
+func (s *boltStore) Validators(tenant string) (map[yearMonth]monthValidator, error) {
+	vs := make(map[yearMonth]monthValidator)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tenant))
+		if b == nil {
+			return nil
+		}
+
+		return b.Bucket(validatorsBucket).ForEach(func(k, data []byte) error {
+			ym, err := parseMonth(string(k))
+			if err != nil {
+				return err
+			}
+
+			var v monthValidator
+			if err := json.Unmarshal(data, &v); err != nil {
+				return fmt.Errorf("Unable to decode the validator of [%s]: %+v", ym, err)
+			}
+			vs[ym] = v
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the validators of [%s]: %+v", tenant, err)
+	}
+
+	return vs, nil
+}
+
+func (s *boltStore) SetValidators(tenant string, validators map[yearMonth]monthValidator) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tenantBucket(tx, tenant)
+		if err != nil {
+			return err
+		}
+
+		for ym, v := range validators {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := b.Bucket(validatorsBucket).Put([]byte(ym.String()), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to store the validators of [%s]: %+v", tenant, err)
+	}
+
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// tenantBucket returns the bucket of the tenant, creating it if needed.
+func tenantBucket(tx *bolt.Tx, tenant string) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(tenant))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range [][]byte{itemsBucket, startBucket, validatorsBucket} {
+		if _, err := b.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// startKey returns the key of an item in the start time index. The sign bit of the time is
+// flipped so that times before 1970 are ordered correctly as well.
+func startKey(start time.Time, uid string) []byte {
+	k := make([]byte, 8, 8+len(uid))
+	binary.BigEndian.PutUint64(k, uint64(start.UnixNano())^(1<<63))
+	return append(k, uid...)
+}
+
+func getItem(b *bolt.Bucket, uid string) (CalItem, bool, error) {
+	data := b.Bucket(itemsBucket).Get([]byte(uid))
+	if data == nil {
+		return CalItem{}, false, nil
+	}
+
+	var si storedItem
+	if err := json.Unmarshal(data, &si); err != nil {
+		return CalItem{}, false, fmt.Errorf("Unable to decode item [%s]: %+v", uid, err)
+	}
+	return si.item(), true, nil
+}
+
+// putItem writes the item and updates the start time index.
+func putItem(b *bolt.Bucket, i CalItem) error {
+	data, err := json.Marshal(newStoredItem(i))
+	if err != nil {
+		return fmt.Errorf("Unable to encode item [%s]: %+v", i.UID, err)
+	}
+
+	prev, ok, err := getItem(b, i.UID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := b.Bucket(startBucket).Delete(startKey(prev.StartDateTime, prev.UID)); err != nil {
+			return err
+		}
+	}
+	if err := b.Bucket(startBucket).Put(startKey(i.StartDateTime, i.UID), nil); err != nil {
+		return err
+	}
+	return b.Bucket(itemsBucket).Put([]byte(i.UID), data)
+}
+
+// rangeItems returns the items that start in [from, to), ordered by start time.
+func rangeItems(b *bolt.Bucket, from time.Time, to time.Time) ([]CalItem, error) {
+	var items []CalItem
+
+	end := startKey(to, "")
+	c := b.Bucket(startBucket).Cursor()
+	for k, _ := c.Seek(startKey(from, "")); k != nil && bytes.Compare(k[:8], end) < 0; k, _ = c.Next() {
+		i, ok, err := getItem(b, string(k[8:]))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			items = append(items, i)
+		}
+	}
+
+	return items, nil
+}
@@ -15,23 +15,50 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 )
 
-const generatedMonths = 18
+const monthLayout = "2006-01"
 
-var httpGet = http.Get
+// The fetch window, in whole months around the current month
+var (
+	fetchMonthsBack  = 5
+	fetchMonthsAhead = 12
+)
+
+// Settings for the requests to Notubiz
+var (
+	httpClient   = &http.Client{}
+	fetchTimeout = 30 * time.Second       // per request
+	fetchRetries = 3                      // retries on network errors and 5xx responses
+	fetchBackoff = 500 * time.Millisecond // base of the exponential backoff between retries
+)
 
+// upstreamStatusError is returned when Notubiz answers with something other than 200 OK.
+type upstreamStatusError struct {
+	Status     string
+	StatusCode int
+}
+
+func (e upstreamStatusError) Error() string {
+	return fmt.Sprintf("Unexpected response status [%s]", e.Status)
+}
+
+// calendarMonth is the calendar of a month as Notubiz returns it. The meetings are decoded one
+// by one, so that a malformed meeting doesn't fail the whole month.
 type calendarMonth struct {
-	Meetings []CalItem `json:"meetings"`
+	Meetings   []json.RawMessage `json:"meetings"`
+	Categories []category        `json:"categories"`
 }
 
 type yearMonth struct {
@@ -39,78 +66,170 @@ type yearMonth struct {
 	month int
 }
 
-type fetchResult struct {
-	items []CalItem
-	errs  []error
+// parseMonth parses a YYYY-MM month.
+func parseMonth(s string) (yearMonth, error) {
+	m, err := time.Parse(monthLayout, s)
+	if err != nil {
+		return yearMonth{}, fmt.Errorf("Month must be formatted as YYYY-MM, not [%s]!", s)
+	}
+	return yearMonth{year: m.Year(), month: int(m.Month())}, nil
+}
+
+func (ym yearMonth) String() string {
+	return fmt.Sprintf("%04d-%02d", ym.year, ym.month)
+}
+
+func (ym yearMonth) before(o yearMonth) bool {
+	return ym.year < o.year || (ym.year == o.year && ym.month < o.month)
+}
+
+func (ym yearMonth) prev() yearMonth {
+	if ym.month == 1 {
+		return yearMonth{year: ym.year - 1, month: 12}
+	}
+	return yearMonth{year: ym.year, month: ym.month - 1}
+}
+
+func (ym yearMonth) next() yearMonth {
+	if ym.month == 12 {
+		return yearMonth{year: ym.year + 1, month: 1}
+	}
+	return yearMonth{year: ym.year, month: ym.month + 1}
+}
+
+// monthResult is the outcome of fetching a single month.
+type monthResult struct {
+	month     yearMonth
+	items     []CalItem
+	unchanged bool // the stored items of the month are still current
+	skipped   int  // meetings that couldn't be decoded or enriched
+	validator monthValidator
+	drift     schemaDrift
+	wait      time.Duration // spent waiting for the rate limiter
+	err       error
 }
 
-func fetchCalendarItems(fetchStart time.Time) ([]CalItem, error) {
-	// Concurrency stuff
+// fetchCalendarItems fetches all months of the window with a bounded amount of workers. The
+// results are returned per month, in order, so that failed months can be told apart from
+// successful ones.
+func fetchCalendarItems(ctx context.Context, t *tenant, fetchStart time.Time) []monthResult {
 	var wg sync.WaitGroup
-	cc := make(chan []CalItem)
-	ec := make(chan error)
-	result := make(chan fetchResult)
-	cancel := make(chan bool)
-	defer close(cc)
-	defer close(ec)
-	defer close(cancel)
-	defer close(result)
 
 	// Get all the months that we want to fetch
 	yms := generateMonthYearRange(fetchStart)
+	forgetUpstreamMonth(t, yms[0].prev())
+	results := make([]monthResult, len(yms))
 
-	go readChannels(cc, ec, result, cancel)
+	jobs := make(chan int, len(yms))
+	for n := range yms {
+		jobs <- n
+	}
+	close(jobs)
 
-	for _, ym := range yms {
+	queued := time.Now()
+	workers := fetchConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers && w < len(yms); w++ {
 		wg.Add(1)
-		go func(ym yearMonth) {
+		go func() {
 			defer wg.Done()
-
-			json, err := fetchCalendarMonthJSON(ym)
-			if err != nil {
-				ec <- err
-				return
+			for n := range jobs {
+				wait := time.Since(queued)
+				results[n] = fetchMonth(ctx, t, yms[n], fetchStart)
+				t.recordQueueWait(wait + results[n].wait)
 			}
+		}()
+	}
 
-			items, err := getCalendarItemsFromJSON(json, fetchStart)
-			if err != nil {
-				ec <- err
-				return
-			}
+	// Wait for all fetches to finish
+	wg.Wait()
+
+	return results
+}
 
-			cc <- items
+// monthResponse is what Notubiz returned for a month.
+type monthResponse struct {
+	json        string
+	validator   monthValidator
+	notModified bool
+	wait        time.Duration // spent waiting for the rate limiter, also when the fetch failed
+}
 
-		}(ym)
+func fetchMonth(ctx context.Context, t *tenant, ym yearMonth, fetchStart time.Time) monthResult {
+	ctx = withLogger(ctx, logger(ctx).With("month", ym.String()))
+	prev := t.monthValidator(ym)
+	if prev.Enrich != t.enrichFingerprint() {
+		// The stored items were enriched differently, so the month has changed either way
+		prev = monthValidator{}
 	}
 
-	// Wait for all fetches to finish
-	wg.Wait()
+	resp, err := fetchCalendarMonthJSON(ctx, t, ym, prev)
+	fail := func(err error, drift schemaDrift) monthResult {
+		monthErrors.WithLabelValues(t.Name, errorReason(err)).Inc()
+		logger(ctx).Warn("Unable to fetch month", "reason", errorReason(err), "err", err)
+		return monthResult{month: ym, err: err, drift: drift, wait: resp.wait}
+	}
+	if err != nil {
+		return fail(err, schemaDrift{})
+	}
+
+	// Skip parsing if the month is the same as the one we stored the last time
+	if resp.notModified || (prev.Hash != "" && resp.validator.Hash == prev.Hash) {
+		return monthResult{month: ym, unchanged: true, validator: resp.validator, wait: resp.wait}
+	}
+
+	drift := detectDrift([]byte(resp.json))
 
-	// Cancel the gathering goroutine
-	cancel <- true
+	items, skipped, err := getCalendarItemsFromJSON(ctx, t, resp.json, fetchStart)
+	if err != nil {
+		return fail(err, drift)
+	}
 
-	// Get the result
-	fr := <-result
+	return monthResult{month: ym, items: items, skipped: skipped, validator: resp.validator, drift: drift, wait: resp.wait}
+}
 
-	if len(fr.errs) == 0 {
-		return fr.items, nil
+// replacedMonths returns the months of which the stored items are replaced by the fetched items.
+// A month in which meetings were skipped only adds and updates items, so that the stored copies
+// of the skipped meetings aren't marked as removed.
+func (r monthResult) replacedMonths() []yearMonth {
+	if r.skipped > 0 {
+		return nil
 	}
+	return []yearMonth{r.month}
+}
 
+// splitMonthResults returns the items that were fetched successfully and have changed, the months
+// that they replace, and an error describing the months that failed (or nil).
+func splitMonthResults(results []monthResult) ([]CalItem, []yearMonth, error) {
+	var items []CalItem
+	var months []yearMonth
 	var errString bytes.Buffer
-	errString.WriteString("Could not update items because the following error(s) occurred:")
-	for _, err := range fr.errs {
-		errString.WriteString("\n" + err.Error())
+
+	for _, r := range results {
+		if r.err != nil {
+			errString.WriteString(fmt.Sprintf("\n[%s]: %s", r.month, r.err.Error()))
+			continue
+		}
+		if r.unchanged {
+			continue
+		}
+		items = append(items, r.items...)
+		months = append(months, r.replacedMonths()...)
 	}
 
-	return nil, errors.New(errString.String())
+	if errString.Len() == 0 {
+		return items, months, nil
+	}
 
+	return items, months, errors.New("Could not fetch the following month(s):" + errString.String())
 }
 
 func generateMonthYearRange(locus time.Time) []yearMonth {
 	var generated []yearMonth
 
-	// Always start the range 5 months before the locus
-	for i := -5; i < generatedMonths-5; i++ {
+	for i := -fetchMonthsBack; i <= fetchMonthsAhead; i++ {
 		d := locus.AddDate(0, i, 0)
 		generated = append(generated, yearMonth{year: d.Year(), month: int(d.Month())})
 	}
@@ -118,70 +237,152 @@ func generateMonthYearRange(locus time.Time) []yearMonth {
 	return generated
 }
 
-func readChannels(cc <-chan []CalItem, ec <-chan error, result chan fetchResult, cancel <-chan bool) {
-	var cancelled = false
-	var items []CalItem
-	var errs []error
-
-	for !cancelled {
-		select {
-		case fetchedItem := <-cc:
-			items = append(items, fetchedItem...)
-		case fetchErr := <-ec:
-			errs = append(errs, fetchErr)
-		case <-cancel:
-			cancelled = true
+// fetchCalendarMonthJSON fetches a month, conditionally if a validator of an earlier fetch is given.
+func fetchCalendarMonthJSON(ctx context.Context, t *tenant, ym yearMonth, prev monthValidator) (monthResponse, error) {
+	calendarURL := t.calendarURL(ym)
+
+	var lastErr error
+	var waited time.Duration
+	for attempt := 0; attempt <= fetchRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepBackoff(ctx, attempt); err != nil {
+				break
+			}
 		}
 
-	}
+		wait, err := notubizLimiter.wait(ctx)
+		waited += wait
+		if err != nil {
+			lastErr = err
+			break
+		}
 
-	result <- fetchResult{
-		items: items,
-		errs:  errs,
+		start := time.Now()
+		body, header, retry, err := fetchOnce(ctx, calendarURL, prev)
+		observeUpstream(t, ym, time.Since(start), body, err)
+		logger(ctx).Debug("Fetched month", "attempt", attempt, "not_modified", err == nil && body == nil,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000, "err", err)
+		if err == nil && body == nil {
+			return monthResponse{validator: prev.update(header, true), notModified: true, wait: waited}, nil
+		}
+		if err == nil {
+			json, err := decodeJSONP(body)
+			if err != nil {
+				return monthResponse{wait: waited}, fmt.Errorf("Could not decode the calendar from [%s]: %w", calendarURL, err)
+			}
+			v := prev.update(header, false)
+			v.Hash = hashBody(string(json))
+			v.Enrich = t.enrichFingerprint()
+			return monthResponse{json: string(json), validator: v, wait: waited}, nil
+		}
+
+		lastErr = err
+		if !retry {
+			break
+		}
 	}
+
+	return monthResponse{wait: waited}, fmt.Errorf("Could not fetch the calendar from [%s]: %w", calendarURL, lastErr)
 }
 
-func fetchCalendarMonthJSON(ym yearMonth) (string, error) {
-	calendarURL := fmt.Sprintf("https://leiden.notubiz.nl/api/calendar/callback_function?year=%d&month=%d&callback=raad071cal", ym.year, ym.month)
-	resp, err := httpGet(calendarURL)
+// fetchOnce does a single (conditional) request with its own timeout. The body is nil if the
+// month was not modified. It reports whether the request is worth retrying if it fails.
+func fetchOnce(ctx context.Context, url string, v monthValidator) ([]byte, http.Header, bool, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
 	if err != nil {
-		return "", fmt.Errorf("Could not fetch the calendar from [%s]: %+v", calendarURL, err)
+		return nil, nil, false, err
 	}
+	v.setRequestHeaders(req)
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("Could not read the calender URL contents: %+v", err)
+		// Network errors and timeouts are retried, unless the whole fetch was cancelled
+		return nil, nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, resp.Header, false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096)) // so the connection can be reused
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, nil, retry, upstreamStatusError{Status: resp.Status, StatusCode: resp.StatusCode}
 	}
 
-	text := strings.TrimSuffix(strings.TrimPrefix(string(bytes[:]), "callback_function("), ")")
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, ctx.Err() == nil, fmt.Errorf("Could not read the calendar URL contents: %w", err)
+	}
 
-	return text, nil
+	return body, resp.Header, false, nil
 }
 
-func getCalendarItemsFromJSON(cpJSON string, fetchStart time.Time) ([]CalItem, error) {
-	var cp calendarMonth
+// sleepBackoff waits before the given retry, using exponential backoff with full jitter. It
+// returns early with an error if the context is done.
+func sleepBackoff(ctx context.Context, attempt int) error {
+	max := fetchBackoff << uint(attempt-1)
+	wait := time.Duration(rand.Int63n(int64(max) + 1))
 
-	err := json.Unmarshal([]byte(cpJSON), &cp)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
 
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// getCalendarItemsFromJSON returns the meetings of a month, and the number of meetings that were
+// skipped because they couldn't be decoded or enriched.
+func getCalendarItemsFromJSON(ctx context.Context, t *tenant, cpJSON string, fetchStart time.Time) ([]CalItem, int, error) {
+	cp, err := decodeCalendarMonth([]byte(cpJSON))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse JSON calendar items! Error: %+v", err)
+		return nil, 0, fmt.Errorf("Unable to parse JSON calendar items! Error: %w", err)
 	}
 
 	items := make([]CalItem, 0, len(cp.Meetings))
+	skipped := 0
+
+	cats := make(map[int]category, len(cp.Categories))
+	for _, c := range cp.Categories {
+		cats[c.ID] = c
+	}
 
-	for _, i := range cp.Meetings {
-		if strings.ToLower(i.Description) == "fractievergadering" || i.Canceled {
+	for _, raw := range cp.Meetings {
+		var m notubizMeeting
+		if err := json.Unmarshal(raw, &m); err != nil {
+			logger(ctx).Warn("Skipping malformed meeting", "meeting", snippet(raw), "err", err)
+			enrichErrors.WithLabelValues(t.Name).Inc()
+			skipped++
 			continue
 		}
 
-		ei, err := EnrichItem(i, fetchStart)
+		i := m.item()
+		if strings.ToLower(i.Description) == "fractievergadering" {
+			continue
+		}
+
+		if i.CommitteeID != 0 {
+			i.Committee = cats[i.CommitteeID]
+		}
+
+		ei, err := EnrichItem(ctx, t, i, fetchStart)
 		if err != nil {
-			log.Printf("ERROR - Unable to enrich item [%+v]: %+v", ei, err)
+			logger(ctx).Error("Unable to enrich meeting", "meeting", i.ID, "date", i.Date, "time", i.Time, "err", err)
+			enrichErrors.WithLabelValues(t.Name).Inc()
+			skipped++
 			continue
 		}
 
 		items = append(items, ei)
 	}
 
-	return items, nil
+	return items, skipped, nil
 }
@@ -14,50 +14,164 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// generatedMonths is the size of the default fetch window.
+const generatedMonths = 18
+
+// newTestUpstream starts a fake Notubiz API and returns a tenant that fetches from it.
+func newTestUpstream(h func(w http.ResponseWriter, r *http.Request, ym yearMonth)) (*tenant, *httptest.Server) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		year, _ := strconv.Atoi(r.URL.Query().Get("year"))
+		month, _ := strconv.Atoi(r.URL.Query().Get("month"))
+		h(w, r, yearMonth{year, month})
+	}))
+
+	tt := GetTestTenant()
+	tt.APIBase = srv.URL
+
+	return tt, srv
+}
+
+// serveTestFile returns an upstream handler that answers every month with the given file.
+func serveTestFile(file string) func(http.ResponseWriter, *http.Request, yearMonth) {
+	tstJSON, _ := ioutil.ReadFile(file)
+	return func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		io.WriteString(w, "callback_function("+string(tstJSON)+")")
+	}
+}
+
+// dropConnection simulates a network error.
+func dropConnection(w http.ResponseWriter) {
+	conn, _, _ := w.(http.Hijacker).Hijack()
+	conn.Close()
+}
+
 func TestSuccessfulFetch(t *testing.T) {
 	var reqURL string
 
-	httpGet = func(url string) (*http.Response, error) {
-		reqURL = url
-		return &http.Response{
-			Body: ioutil.NopCloser(bytes.NewBufferString("callback_function({})")),
-		}, nil
-	}
-	defer func() {
-		httpGet = http.Get
-	}()
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		reqURL = r.URL.String()
+		io.WriteString(w, "callback_function({})")
+	})
+	defer srv.Close()
 
 	expected := "{}"
-	result, _ := fetchCalendarMonthJSON(yearMonth{2016, 8})
+	result, err := fetchCalendarMonthJSON(context.Background(), tt, yearMonth{2016, 8}, monthValidator{})
 
+	assert.Nil(t, err, "Unable to fetch calendar month!")
+	assert.Contains(t, reqURL, "/api/calendar/", "Incorrect request path!")
 	assert.Contains(t, reqURL, "year=2016&month=8", "Incorrect request URL!")
-	assert.Equal(t, expected, result, "Calendar month incorrectly fetched!")
+	assert.Equal(t, expected, result.json, "Calendar month incorrectly fetched!")
+}
+
+func TestCalendarURLShouldUseTheNotubizHost(t *testing.T) {
+	assert.Equal(t, "https://leiden.notubiz.nl/api/calendar/callback_function?year=2016&month=8&callback=raad071cal", GetTestTenant().calendarURL(yearMonth{2016, 8}))
 }
 
 func TestFailureFetch(t *testing.T) {
-	httpGet = func(string) (*http.Response, error) {
-		return nil, errors.New("Eep!")
-	}
-	defer func() {
-		httpGet = http.Get
-	}()
+	var requests int32
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		atomic.AddInt32(&requests, 1)
+		dropConnection(w)
+	})
+	defer srv.Close()
 
-	_, err := fetchCalendarMonthJSON(yearMonth{2016, 8})
+	_, err := fetchCalendarMonthJSON(context.Background(), tt, yearMonth{2016, 8}, monthValidator{})
 
 	assert.NotNil(t, err, "Incorrect calendar month fetch did not result in an error!")
+	assert.Equal(t, int32(fetchRetries+1), atomic.LoadInt32(&requests), "Network error was not retried!")
+}
+
+func TestFetchShouldRetryServerErrors(t *testing.T) {
+	var requests int32
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "Eep!", http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "callback_function({})")
+	})
+	defer srv.Close()
+
+	result, err := fetchCalendarMonthJSON(context.Background(), tt, yearMonth{2016, 8}, monthValidator{})
+
+	assert.Nil(t, err, "Fetch was not retried!")
+	assert.Equal(t, "{}", result.json, "Calendar month incorrectly fetched!")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "Wrong amount of requests!")
+}
+
+func TestFetchShouldNotRetryClientErrors(t *testing.T) {
+	var requests int32
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	})
+	defer srv.Close()
+
+	_, err := fetchCalendarMonthJSON(context.Background(), tt, yearMonth{2016, 8}, monthValidator{})
+
+	if assert.NotNil(t, err, "404 did not result in an error!") {
+		assert.Contains(t, err.Error(), "Unexpected response status [404 Not Found]", "Wrong error!")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "Client error was retried!")
+}
+
+func TestFetchShouldTimeOut(t *testing.T) {
+	defer func(ft time.Duration, fr int) {
+		fetchTimeout = ft
+		fetchRetries = fr
+	}(fetchTimeout, fetchRetries)
+	fetchTimeout = 50 * time.Millisecond
+	fetchRetries = 1
+
+	release := make(chan bool)
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	_, err := fetchCalendarMonthJSON(context.Background(), tt, yearMonth{2016, 8}, monthValidator{})
+
+	assert.NotNil(t, err, "Hanging request did not result in an error!")
+	assert.True(t, time.Since(start) < 5*time.Second, "Request did not time out!")
+}
+
+func TestFetchShouldStopWhenCancelled(t *testing.T) {
+	var requests int32
+	ctx, cancel := context.WithCancel(context.Background())
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		atomic.AddInt32(&requests, 1)
+		cancel()
+		http.Error(w, "Eep!", http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+
+	_, err := fetchCalendarMonthJSON(ctx, tt, yearMonth{2016, 8}, monthValidator{})
+
+	assert.NotNil(t, err, "Cancelled fetch did not result in an error!")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "Cancelled fetch was retried!")
 }
 
 func TestGetCalendarItemsFromJSON(t *testing.T) {
 	tstJSON, _ := ioutil.ReadFile("../../../../testfiles/tst.json")
-	result, err := getCalendarItemsFromJSON(string(tstJSON), GetTestTime())
+	result, _, err := getCalendarItemsFromJSON(context.Background(), GetTestTenant(), string(tstJSON), GetTestTime())
 	expected := []CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()}
 
 	assert.Nil(t, err, "Unable to get calendar items!")
@@ -70,6 +184,63 @@ func TestGetCalendarItemsFromJSON(t *testing.T) {
 	assert.Equal(t, expected, result, "Test JSON rendered incorrect items!")
 }
 
+func TestCancelledMeetingsShouldBeKept(t *testing.T) {
+	json := `{"success": true, "meetings": [
+		{"id": 1, "canceled": true, "description": "Gemeenteraad", "location": "Raadzaal", "documents": [], "date": "23-06-2016", "time": "20:00"},
+		{"id": 2, "canceled": false, "description": "Fractievergadering", "location": "", "documents": [], "date": "23-06-2016", "time": "20:00"}
+	]}`
+
+	result, _, err := getCalendarItemsFromJSON(context.Background(), GetTestTenant(), json, GetTestTime())
+
+	assert.Nil(t, err, "Unable to get calendar items!")
+	if assert.Equal(t, 1, len(result), "Wrong amount of items!") {
+		assert.True(t, result[0].Canceled, "Cancelled meeting lost its status!")
+	}
+}
+
+func TestMalformedMeetingsShouldBeSkipped(t *testing.T) {
+	json := `{"success": true, "meetings": [
+		{"id": "1", "canceled": false, "description": "Gemeenteraad", "location": "Raadzaal", "documents": [], "date": "23-06-2016", "time": "20:00"},
+		{"id": 2, "canceled": false, "description": "Gemeenteraad", "location": "Raadzaal", "documents": [], "date": "30-06-2016", "time": "20:00"}
+	]}`
+
+	result, skipped, err := getCalendarItemsFromJSON(context.Background(), GetTestTenant(), json, GetTestTime())
+
+	assert.Nil(t, err, "A malformed meeting failed the month!")
+	assert.Equal(t, 1, skipped, "Skipped meeting not counted!")
+	if assert.Equal(t, 1, len(result), "Wrong amount of items!") {
+		assert.Equal(t, "leiden-2", result[0].UID, "Wrong meeting skipped!")
+	}
+}
+
+func TestUnusedFieldsShouldNotSkipAMeeting(t *testing.T) {
+	json := `{"success": true, "meetings": [
+		{"id": 1, "canceled": false, "description": "Gemeenteraad", "confidential": "nee", "location": "Raadzaal", "documents": [], "date": "23-06-2016", "time": "20:00"}
+	]}`
+
+	result, skipped, err := getCalendarItemsFromJSON(context.Background(), GetTestTenant(), json, GetTestTime())
+
+	assert.Nil(t, err, "Unable to get calendar items!")
+	assert.Equal(t, 0, skipped, "Meeting skipped over a field we don't use!")
+	assert.Equal(t, 1, len(result), "Wrong amount of items!")
+}
+
+func TestMonthsWithSkippedMeetingsShouldNotBeReplaced(t *testing.T) {
+	store = newMemoryStore()
+	store.Replace(defaultTenant, []yearMonth{testMonth}, []CalItem{GetTestItem1(), GetTestItem2()}, GetTestTime())
+
+	// Item 2 can't be decoded anymore
+	results := []monthResult{{month: testMonth, items: []CalItem{GetTestItem1()}, skipped: 1, validator: monthValidator{Hash: "abc"}}}
+	items, months, err := splitMonthResults(results)
+	assert.Nil(t, err, "Skipped meeting failed the month!")
+	assert.Empty(t, months, "Month with a skipped meeting is replaced!")
+
+	store.Replace(defaultTenant, months, items, GetTestTime().Add(time.Hour))
+	i, _, _ := store.Get(defaultTenant, GetTestItem2().UID)
+	assert.False(t, i.Removed, "Skipped meeting was marked as removed!")
+	assert.Equal(t, monthValidator{}, monthValidators(results)[testMonth], "Month with a skipped meeting is not parsed again!")
+}
+
 func TestGenerateMonthYearRange(t *testing.T) {
 	expected := []yearMonth{
 		{2016, 1},
@@ -97,6 +268,18 @@ func TestGenerateMonthYearRange(t *testing.T) {
 	assert.Equal(t, expected, result, "Test item incorrectly rendered!")
 }
 
+func TestYearMonthArithmetic(t *testing.T) {
+	ym, err := parseMonth("2016-12")
+	assert.Nil(t, err, "Unable to parse month!")
+	assert.Equal(t, yearMonth{2017, 1}, ym.next(), "Wrong next month!")
+	assert.Equal(t, "2016-12", ym.String(), "Wrong month string!")
+	assert.True(t, ym.before(ym.next()), "Month not before the next one!")
+	assert.False(t, ym.before(ym), "Month before itself!")
+
+	_, err = parseMonth("12-2016")
+	assert.NotNil(t, err, "Invalid month was accepted!")
+}
+
 func TestFetchCalendarItemsSuccess(t *testing.T) {
 	testSet := []struct {
 		srcFile     string
@@ -108,20 +291,11 @@ func TestFetchCalendarItemsSuccess(t *testing.T) {
 		{"../../../../testfiles/ghi-1.json", 90},
 	}
 
-	// Make sure we reset the httpGet
-	defer func() {
-		httpGet = http.Get
-	}()
-
 	for _, i := range testSet {
-		tstJSON, _ := ioutil.ReadFile(i.srcFile)
-		httpGet = func(url string) (*http.Response, error) {
-			return &http.Response{
-				Body: ioutil.NopCloser(bytes.NewBufferString("callback_function(" + string(tstJSON) + ")")),
-			}, nil
-		}
+		tt, srv := newTestUpstream(serveTestFile(i.srcFile))
+		items, _, err := splitMonthResults(fetchCalendarItems(context.Background(), tt, GetTestTime()))
+		srv.Close()
 
-		items, err := fetchCalendarItems(GetTestTime())
 		if err != nil {
 			t.Errorf("Errors were returned. Something went wrong: [%+v]", err)
 		}
@@ -134,17 +308,39 @@ func TestFetchCalendarItemsSuccess(t *testing.T) {
 }
 
 func TestFetchCalendarItemsFailureInvalidJson(t *testing.T) {
-	httpGet = func(url string) (*http.Response, error) {
-		return &http.Response{
-			Body: ioutil.NopCloser(bytes.NewBufferString("callback_function({\"bla\": asfasdfasdf})")),
-		}, nil
-	}
-	defer func() {
-		httpGet = http.Get
-	}()
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		io.WriteString(w, "callback_function({\"bla\": asfasdfasdf})")
+	})
+	defer srv.Close()
 
-	_, err := fetchCalendarItems(GetTestTime())
+	_, months, err := splitMonthResults(fetchCalendarItems(context.Background(), tt, GetTestTime()))
 	if err == nil {
 		t.Fatal("No error was returned even though the input is invalid!")
 	}
+	assert.Empty(t, months, "Months with invalid input were reported as successful!")
+}
+
+func TestFetchCalendarItemsPartialFailure(t *testing.T) {
+	serve := serveTestFile("../../../../testfiles/tst.json")
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if ym == (yearMonth{2016, 8}) {
+			dropConnection(w)
+			return
+		}
+		serve(w, r, ym)
+	})
+	defer srv.Close()
+
+	results := fetchCalendarItems(context.Background(), tt, GetTestTime())
+	items, months, err := splitMonthResults(results)
+
+	assert.Equal(t, 18, len(results), "Wrong amount of month results!")
+	assert.Equal(t, yearMonth{2016, 8}, results[7].month, "Month results out of order!")
+	assert.NotNil(t, results[7].err, "Failed month has no error!")
+	assert.Equal(t, 17, len(months), "Wrong amount of successful months!")
+	assert.NotContains(t, months, yearMonth{2016, 8}, "Failed month reported as successful!")
+	assert.Equal(t, 17*3, len(items), "Wrong amount of items!")
+	if assert.NotNil(t, err, "Partial failure did not result in an error!") {
+		assert.Contains(t, err.Error(), "[2016-08]: Could not fetch", "Error doesn't mention the failed month!")
+	}
 }
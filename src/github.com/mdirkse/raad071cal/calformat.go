@@ -0,0 +1,242 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// This file contains the jCal (RFC 7265) and xCal (RFC 6321) representations of a calendar.
+// Both are written from the same tree of components and properties as the iCalendar output,
+// so the formats only differ in their syntax.
+
+const xcalNamespace = "urn:ietf:params:xml:ns:icalendar-2.0"
+
+// calFormat is a representation in which a calendar can be served.
+type calFormat struct {
+	ext         string // of the feed path, eg. alles.ics
+	contentType string
+	encode      func(icalComponent, io.Writer) error
+}
+
+// The supported formats, in order of preference.
+var (
+	formatICal = calFormat{"ics", "text/calendar", icalComponent.encode}
+	formatJCal = calFormat{"json", "application/calendar+json", icalComponent.encodeJCal}
+	formatXCal = calFormat{"xml", "application/calendar+xml", icalComponent.encodeXCal}
+
+	calFormats = []calFormat{formatICal, formatJCal, formatXCal}
+)
+
+// negotiateFormat returns the format to use for the given Accept header. Clients that don't
+// ask for one of the formats explicitly get iCalendar.
+func negotiateFormat(accept string) calFormat {
+	best, bestQ := formatICal, 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		for _, f := range calFormats {
+			if f.contentType == mediaType && q > bestQ {
+				best, bestQ = f, q
+			}
+		}
+	}
+
+	return best
+}
+
+// structuredValue returns the value of the property as it is written in jCal and xCal, which
+// use the ISO 8601 extended format for dates, times and offsets.
+func (p icalProperty) structuredValue() string {
+	v := p.Value
+
+	switch p.Type {
+	case icalDate:
+		if len(v) == len(icalDateLayout) {
+			return v[0:4] + "-" + v[4:6] + "-" + v[6:8]
+		}
+	case icalDateTime:
+		if len(v) >= len(icalLocalLayout) {
+			return v[0:4] + "-" + v[4:6] + "-" + v[6:8] + "T" + v[9:11] + ":" + v[11:13] + ":" + v[13:]
+		}
+	case icalOffset:
+		if len(v) >= 5 {
+			o := v[0:3] + ":" + v[3:5]
+			if len(v) == 7 {
+				o += ":" + v[5:7]
+			}
+			return o
+		}
+	}
+
+	return v
+}
+
+// typeName returns the name of the value type as used in jCal and xCal, eg. date-time.
+func (p icalProperty) typeName() string {
+	if p.Type == "" {
+		return "unknown"
+	}
+	return strings.ToLower(string(p.Type))
+}
+
+// structuredParams returns the parameters of the property, except VALUE which is replaced
+// by the type of the value in jCal and xCal.
+func (p icalProperty) structuredParams() []icalParam {
+	var ps []icalParam
+	for _, prm := range p.Params {
+		if prm.Name != "VALUE" {
+			ps = append(ps, prm)
+		}
+	}
+	return ps
+}
+
+// encodeJCal writes the component as jCal.
+func (c icalComponent) encodeJCal(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(c.jcal()); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// jcal returns the component as a jCal array: [name, properties, components].
+func (c icalComponent) jcal() []interface{} {
+	props := make([]interface{}, 0, len(c.Properties))
+	for _, p := range c.Properties {
+		params := make(map[string]interface{})
+		for _, prm := range p.structuredParams() {
+			if len(prm.Values) == 1 {
+				params[strings.ToLower(prm.Name)] = prm.Values[0]
+			} else {
+				params[strings.ToLower(prm.Name)] = prm.Values
+			}
+		}
+
+		var v interface{} = p.structuredValue()
+		if p.Type == icalInteger {
+			if n, err := strconv.Atoi(p.Value); err == nil {
+				v = n
+			}
+		}
+
+		props = append(props, []interface{}{strings.ToLower(p.Name), params, p.typeName(), v})
+	}
+
+	comps := make([]interface{}, 0, len(c.Components))
+	for _, sc := range c.Components {
+		comps = append(comps, sc.jcal())
+	}
+
+	return []interface{}{strings.ToLower(c.Name), props, comps}
+}
+
+// encodeXCal writes the component as an xCal document.
+func (c icalComponent) encodeXCal(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(bw)
+	root := xml.StartElement{Name: xml.Name{Local: "icalendar"}, Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: xcalNamespace}}}
+	enc.EncodeToken(root)
+	c.xcal(enc)
+	enc.EncodeToken(root.End())
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+
+	bw.WriteString("\n")
+	return bw.Flush()
+}
+
+// xcal writes the component as an element with its properties and sub components.
+func (c icalComponent) xcal(enc *xml.Encoder) {
+	el := xmlStart(c.Name)
+	enc.EncodeToken(el)
+
+	if len(c.Properties) > 0 {
+		props := xmlStart("properties")
+		enc.EncodeToken(props)
+		for _, p := range c.Properties {
+			pel := xmlStart(p.Name)
+			enc.EncodeToken(pel)
+
+			if params := p.structuredParams(); len(params) > 0 {
+				pels := xmlStart("parameters")
+				enc.EncodeToken(pels)
+				for _, prm := range params {
+					xmlElement(enc, xmlStart(prm.Name), "text", prm.Values...)
+				}
+				enc.EncodeToken(pels.End())
+			}
+
+			xmlValue(enc, p.typeName(), p.structuredValue())
+			enc.EncodeToken(pel.End())
+		}
+		enc.EncodeToken(props.End())
+	}
+
+	if len(c.Components) > 0 {
+		comps := xmlStart("components")
+		enc.EncodeToken(comps)
+		for _, sc := range c.Components {
+			sc.xcal(enc)
+		}
+		enc.EncodeToken(comps.End())
+	}
+
+	enc.EncodeToken(el.End())
+}
+
+func xmlStart(name string) xml.StartElement {
+	return xml.StartElement{Name: xml.Name{Local: strings.ToLower(name)}}
+}
+
+// xmlElement writes el with a value element of the given type for every value.
+func xmlElement(enc *xml.Encoder, el xml.StartElement, valueType string, values ...string) {
+	enc.EncodeToken(el)
+	for _, v := range values {
+		xmlValue(enc, valueType, v)
+	}
+	enc.EncodeToken(el.End())
+}
+
+func xmlValue(enc *xml.Encoder, valueType string, v string) {
+	vel := xmlStart(valueType)
+	enc.EncodeToken(vel)
+	enc.EncodeToken(xml.CharData(v))
+	enc.EncodeToken(vel.End())
+}
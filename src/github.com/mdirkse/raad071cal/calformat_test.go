@@ -0,0 +1,178 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testFormatComponent() icalComponent {
+	c := icalComponent{Name: "VCALENDAR"}
+	c.add(textProp("VERSION", "2.0"))
+
+	e := icalComponent{Name: "VEVENT"}
+	e.add(icalProperty{Name: "SEQUENCE", Type: icalInteger, Value: "2"})
+	e.add(dateProp("DTSTART", GetTestTime()))
+	e.add(localProp("DTEND", GetTestTime(), cestTz))
+	e.add(utcProp("DTSTAMP", GetTestTime()))
+	e.add(textProp("SUMMARY", "Raad & <commissie>, deel 1\n"))
+	c.Components = append(c.Components, e)
+
+	tz := icalComponent{Name: "DAYLIGHT"}
+	tz.add(icalProperty{Name: "TZOFFSETTO", Type: icalOffset, Value: "+0200"})
+	c.Components = append(c.Components, tz)
+
+	return c
+}
+
+func TestJCalShouldFollowTheICalModel(t *testing.T) {
+	var b bytes.Buffer
+	err := testFormatComponent().encodeJCal(&b)
+
+	assert.Nil(t, err, "Unable to write jCal!")
+	assert.Equal(t, `["vcalendar",[["version",{},"text","2.0"]],[`+
+		`["vevent",[["sequence",{},"integer",2],["dtstart",{},"date","2016-06-23"],`+
+		`["dtend",{"tzid":"Europe/Amsterdam"},"date-time","2016-06-23T16:00:00"],`+
+		`["dtstamp",{},"date-time","2016-06-23T14:00:00Z"],["summary",{},"text","Raad & <commissie>, deel 1\n"]],[]],`+
+		`["daylight",[["tzoffsetto",{},"utc-offset","+02:00"]],[]]]]`+"\n", b.String(), "Wrong jCal!")
+}
+
+func TestXCalShouldFollowTheICalModel(t *testing.T) {
+	var b bytes.Buffer
+	err := testFormatComponent().encodeXCal(&b)
+
+	assert.Nil(t, err, "Unable to write xCal!")
+	assert.Equal(t, xml.Header+`<icalendar xmlns="urn:ietf:params:xml:ns:icalendar-2.0"><vcalendar>`+
+		`<properties><version><text>2.0</text></version></properties><components>`+
+		`<vevent><properties><sequence><integer>2</integer></sequence><dtstart><date>2016-06-23</date></dtstart>`+
+		`<dtend><parameters><tzid><text>Europe/Amsterdam</text></tzid></parameters><date-time>2016-06-23T16:00:00</date-time></dtend>`+
+		`<dtstamp><date-time>2016-06-23T14:00:00Z</date-time></dtstamp>`+
+		`<summary><text>Raad &amp; &lt;commissie&gt;, deel 1`+"\n"+`</text></summary></properties></vevent>`+
+		`<daylight><properties><tzoffsetto><utc-offset>+02:00</utc-offset></tzoffsetto></properties></daylight>`+
+		`</components></vcalendar></icalendar>`+"\n", b.String(), "Wrong xCal!")
+}
+
+// xcalElement is a generic xCal element, to compare its structure with the jCal output.
+type xcalElement struct {
+	XMLName  xml.Name
+	Text     string        `xml:",chardata"`
+	Children []xcalElement `xml:",any"`
+}
+
+// The formats are written from the same model, so a feed should have the same content in all of them.
+func TestFormatsShouldHaveTheSameContent(t *testing.T) {
+	c := calendarComponent(GetTestTenant().feed(), []CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()})
+
+	var jb, xb bytes.Buffer
+	c.encodeJCal(&jb)
+	c.encodeXCal(&xb)
+
+	var jcal []interface{}
+	assert.Nil(t, json.Unmarshal(jb.Bytes(), &jcal), "jCal is not valid JSON!")
+
+	var xcal xcalElement
+	assert.Nil(t, xml.Unmarshal(xb.Bytes(), &xcal), "xCal is not valid XML!")
+	if !assert.Len(t, xcal.Children, 1, "xCal should have a single calendar!") {
+		return
+	}
+
+	assertSameContent(t, c, jcal, xcal.Children[0])
+}
+
+func assertSameContent(t *testing.T, c icalComponent, jcal []interface{}, xcal xcalElement) {
+	name := strings.ToLower(c.Name)
+	assert.Equal(t, name, jcal[0], "Wrong jCal component!")
+	assert.Equal(t, name, xcal.XMLName.Local, "Wrong xCal component!")
+
+	var xprops, xcomps []xcalElement
+	for _, e := range xcal.Children {
+		switch e.XMLName.Local {
+		case "properties":
+			xprops = e.Children
+		case "components":
+			xcomps = e.Children
+		}
+	}
+
+	jprops, jcomps := jcal[1].([]interface{}), jcal[2].([]interface{})
+	if !assert.Len(t, jprops, len(c.Properties), "Wrong jCal properties of [%s]!", name) ||
+		!assert.Len(t, xprops, len(c.Properties), "Wrong xCal properties of [%s]!", name) {
+		return
+	}
+	for n, p := range c.Properties {
+		jp, xp := jprops[n].([]interface{}), xprops[n]
+		xv := xp.Children[len(xp.Children)-1]
+
+		assert.Equal(t, strings.ToLower(p.Name), jp[0], "Wrong jCal property!")
+		assert.Equal(t, strings.ToLower(p.Name), xp.XMLName.Local, "Wrong xCal property!")
+		assert.Equal(t, p.typeName(), jp[2], "Wrong jCal type of [%s]!", p.Name)
+		assert.Equal(t, p.typeName(), xv.XMLName.Local, "Wrong xCal type of [%s]!", p.Name)
+		if p.Type != icalInteger {
+			assert.Equal(t, p.structuredValue(), jp[3], "Wrong jCal value of [%s]!", p.Name)
+		}
+		assert.Equal(t, p.structuredValue(), xv.Text, "Wrong xCal value of [%s]!", p.Name)
+	}
+
+	if !assert.Len(t, jcomps, len(c.Components), "Wrong jCal components of [%s]!", name) ||
+		!assert.Len(t, xcomps, len(c.Components), "Wrong xCal components of [%s]!", name) {
+		return
+	}
+	for n, sc := range c.Components {
+		assertSameContent(t, sc, jcomps[n].([]interface{}), xcomps[n])
+	}
+}
+
+func TestFormatShouldBeNegotiated(t *testing.T) {
+	for accept, expected := range map[string]calFormat{
+		"":                          formatICal,
+		"*/*":                       formatICal,
+		"text/html":                 formatICal,
+		"application/calendar+json": formatJCal,
+		"application/calendar+xml, application/xml;q=0.9":           formatXCal,
+		"application/calendar+json;q=0.5, application/calendar+xml": formatXCal,
+		"text/calendar;q=0.5, application/calendar+json;q=0.8":      formatJCal,
+		"application/calendar+json;q=0, text/calendar;q=0.1":        formatICal,
+	} {
+		assert.Equal(t, expected.ext, negotiateFormat(accept).ext, "Wrong format for [%s]!", accept)
+	}
+}
+
+func TestFeedShouldBeServedInTheNegotiatedFormat(t *testing.T) {
+	tt := GetTestTenant()
+	tt.setCalItems([]CalItem{GetTestItem3()})
+
+	req, _ := http.NewRequest("GET", "/kalender/alles.ics", nil)
+	req.Header.Set("Accept", "application/calendar+json")
+	w := httptest.NewRecorder()
+	calHandler(tt).ServeHTTP(w, req)
+
+	assert.Equal(t, "application/calendar+json", w.Header().Get("Content-Type"), "Wrong content type!")
+	assert.Equal(t, "Accept, Accept-Encoding", w.Header().Get("Vary"), "Vary missing!")
+	assert.True(t, json.Valid(w.Body.Bytes()), "Feed is not valid jCal!")
+
+	req, _ = http.NewRequest("GET", "/kalender/alles.xml?include=raadscommissie", nil)
+	w = httptest.NewRecorder()
+	calFormatHandler(tt, formatXCal).ServeHTTP(w, req)
+
+	assert.Equal(t, "application/calendar+xml", w.Header().Get("Content-Type"), "Wrong content type!")
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), "Fixed format varies on Accept!")
+	assert.Contains(t, w.Body.String(), "<uid><text>leiden-247980@raad071.mdirkse.nl</text></uid>", "Item missing!")
+}
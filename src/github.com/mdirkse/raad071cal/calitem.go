@@ -15,51 +15,43 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 	"unicode"
 )
 
 const (
 	dateTimeLayout  = "02-01-2006 15:04"
-	agendaURLPrefix = "https://leiden.notubiz.nl"
-	itemTemplateSrc = `BEGIN:VEVENT
-UID:{{.UID}}@raad071.mdirkse.nl
-DTSTAMP:{{.CreatedDateTime.Format "20060102T150405"}}Z
-{{- if .AllDay}}
-DTSTART;VALUE=DATE:{{.StartDateTime.Format "20060102"}}
-DTEND;VALUE=DATE:{{.EndDateTime.Format "20060102"}}
-{{- else}}
-DTSTART:{{.StartDateTime.Format "20060102T150405"}}Z
-DTEND:{{.EndDateTime.Format "20060102T150405"}}Z
-{{- end}}
-SUMMARY:{{.Description}}
-DESCRIPTION:{{- if .Link}}Notubiz link: {{.Link}}\n{{- end}}{{- if .ExtractedDocuments}}Documents:\n{{range .ExtractedDocuments}}- {{.Title}} {{.URL}}\n{{end}}{{- end}}
-LOCATION:{{.Location}}
-END:VEVENT`
-)
-
-var (
-	itemTemplate *template.Template
+	uidDomain       = "raad071.mdirkse.nl"
+	cancelledPrefix = "[GEANNULEERD] "
 )
 
 // CalItem represents a calendar item that can be rendered to iCal.
 type CalItem struct {
+	ID                 int
 	UID                string
+	Sequence           int
+	LastModified       time.Time
 	AllDay             bool
-	Canceled           bool          `json:"canceled"`
-	Description        string        `json:"description"`
-	Location           string        `json:"location"`
-	Link               string        `json:"link"`
-	Documents          []interface{} `json:"documents"`
+	Canceled           bool
+	Removed            bool
+	CanceledAt         time.Time // when the item was first seen cancelled or removed
+	Description        string
+	Location           string
+	Link               string
+	Documents          json.RawMessage // as Notubiz returns them, see ExtractedDocuments
 	ExtractedDocuments []document
-	Date               string `json:"date"`
+	CommitteeID        int
+	Committee          category
+	Date               string // DD-MM-YYYY
 	CreatedDateTime    time.Time
-	Time               string `json:"time"`
+	Time               string // HH:MM
 	StartDateTime      time.Time
 	EndDateTime        time.Time
 }
@@ -69,12 +61,8 @@ type document struct {
 	URL   string `json:"url"`
 }
 
-func initCalItemVars() {
-	itemTemplate = template.Must(template.New("item").Parse(itemTemplateSrc))
-}
-
 // EnrichItem creates a new calendar item from a string input
-func EnrichItem(i CalItem, runStart time.Time) (CalItem, error) {
+func EnrichItem(ctx context.Context, t *tenant, i CalItem, runStart time.Time) (CalItem, error) {
 	i.CreatedDateTime = runStart.In(time.UTC)
 
 	// Figure out what timezone to parse the date/time with
@@ -105,35 +93,100 @@ func EnrichItem(i CalItem, runStart time.Time) (CalItem, error) {
 	i.EndDateTime = getEndTime(i)
 
 	i.Description = upperCaseFirstLetter(i.Description)
-	i.UID = generateID(i)
-	i.Link = renderLink(i)
-	i.Location = renderLocation(i.Location)
+	i.UID = generateID(t, i)
+	i.Link = renderLink(t, i)
+	i.Location = renderLocation(t, i.Location)
 
-	i.ExtractedDocuments = extractDocumentSet(i.Documents)
+	i.ExtractedDocuments = extractDocumentSet(ctx, i.ID, i.Documents)
 
 	return i, nil
 }
+
 func upperCaseFirstLetter(i string) string {
 	s := []rune(i)
+	if len(s) == 0 {
+		return i
+	}
 	s[0] = unicode.ToUpper(s[0])
 	return string(s)
 }
 
 // RenderItem renders a calendar item in iCalendar format
 func (i CalItem) RenderItem(w io.Writer) error {
-	err := itemTemplate.Execute(w, i)
-
-	if err != nil {
-		return fmt.Errorf("Could not render the item [%+v]! (error: [%+v])", i, err)
+	if err := i.vevent().encode(w); err != nil {
+		return fmt.Errorf("Could not render the item [%s]! (error: [%+v])", i.UID, err)
 	}
 
 	return nil
 }
 
-func generateID(i CalItem) string {
+// vevent returns the iCalendar representation of the item.
+func (i CalItem) vevent() icalComponent {
+	e := icalComponent{Name: "VEVENT"}
+
+	e.add(textProp("UID", i.UID+"@"+uidDomain))
+	e.add(utcProp("DTSTAMP", i.CreatedDateTime))
+	if !i.LastModified.IsZero() {
+		e.add(utcProp("LAST-MODIFIED", i.LastModified))
+	}
+	e.add(icalProperty{Name: "SEQUENCE", Type: icalInteger, Value: strconv.Itoa(i.Sequence)})
+
+	if i.AllDay {
+		// DTEND is exclusive, so an all-day item ends at the start of the next day
+		e.add(dateProp("DTSTART", i.StartDateTime))
+		e.add(dateProp("DTEND", i.EndDateTime.AddDate(0, 0, 1)))
+	} else if utcMode {
+		e.add(utcProp("DTSTART", i.StartDateTime))
+		e.add(utcProp("DTEND", i.EndDateTime))
+	} else {
+		e.add(localProp("DTSTART", i.StartDateTime, cestTz))
+		e.add(localProp("DTEND", i.EndDateTime, cestTz))
+	}
+
+	if i.Canceled || i.Removed {
+		e.add(textProp("STATUS", "CANCELLED"))
+	}
+
+	if i.Canceled && prefixCancelled {
+		e.add(textProp("SUMMARY", cancelledPrefix+i.Description))
+	} else {
+		e.add(textProp("SUMMARY", i.Description))
+	}
+	e.add(textProp("DESCRIPTION", renderDescription(i)))
+	e.add(textProp("LOCATION", i.Location))
+	e.add(uriProp("URL", i.Link))
+
+	return e
+}
+
+func renderDescription(i CalItem) string {
+	var d bytes.Buffer
+
+	if i.Link != "" {
+		fmt.Fprintf(&d, "Notubiz link: %s\n", i.Link)
+	}
+
+	if len(i.ExtractedDocuments) > 0 {
+		d.WriteString("Documents:\n")
+		for _, doc := range i.ExtractedDocuments {
+			fmt.Fprintf(&d, "- %s %s\n", doc.Title, doc.URL)
+		}
+	}
+
+	return d.String()
+}
+
+// generateID returns a UID based on the Notubiz meeting id, which stays the same when a meeting
+// is moved or renamed. Meetings without an id fall back to a hash of their time and name, prefixed
+// with the tenant name as well so UIDs stay unique across tenants.
+func generateID(t *tenant, i CalItem) string {
+	if i.ID != 0 {
+		return fmt.Sprintf("%s-%d", t.Name, i.ID)
+	}
+
 	timeStamp := i.StartDateTime.Format(dateTimeLayout)
 	data := []byte(timeStamp + i.Description)
-	return fmt.Sprintf("%x", md5.Sum(data))
+	return fmt.Sprintf("%s-%x", t.Name, md5.Sum(data))
 }
 
 func getEndTime(i CalItem) time.Time {
@@ -141,8 +194,7 @@ func getEndTime(i CalItem) time.Time {
 		return i.StartDateTime
 	}
 
-	// Switch on the first word of the name
-	switch strings.ToLower(strings.Split(i.Description, " ")[0]) {
+	switch itemKind(i) {
 	case "gemeenteraad":
 		return time.Date(i.StartDateTime.Year(), i.StartDateTime.Month(), i.StartDateTime.Day(), 21, 0, 0, 0, time.UTC)
 	case "raadscommissie", "college":
@@ -152,13 +204,58 @@ func getEndTime(i CalItem) time.Time {
 	}
 }
 
-func renderLink(i CalItem) string {
+// dropExpiredCancellations removes the cancelled items that have been cancelled for longer than
+// the grace period. A grace period of 0 keeps them forever.
+func dropExpiredCancellations(items []CalItem, now time.Time, grace time.Duration) []CalItem {
+	if grace <= 0 {
+		return items
+	}
+
+	kept := make([]CalItem, 0, len(items))
+	for _, i := range items {
+		if i.Canceled && now.Sub(canceledSince(i)) > grace {
+			continue
+		}
+		kept = append(kept, i)
+	}
+
+	return kept
+}
+
+// canceledSince returns the time the item was cancelled. Items stored before this was recorded
+// fall back to their modification time.
+func canceledSince(i CalItem) time.Time {
+	if i.CanceledAt.IsZero() {
+		return i.LastModified
+	}
+	return i.CanceledAt
+}
+
+// dropRemoved removes the items that no longer exist upstream. They are kept in the store for
+// the history, but don't belong in the feeds.
+func dropRemoved(items []CalItem) []CalItem {
+	kept := make([]CalItem, 0, len(items))
+	for _, i := range items {
+		if !i.Removed {
+			kept = append(kept, i)
+		}
+	}
+
+	return kept
+}
+
+// itemKind returns the kind of meeting, which is the first word of the name (eg. "gemeenteraad").
+func itemKind(i CalItem) string {
+	return strings.ToLower(strings.Split(i.Description, " ")[0])
+}
+
+func renderLink(t *tenant, i CalItem) string {
 	// Construct the description
 	var description bytes.Buffer
 	if i.Link != "" {
 		// If it's a relative URL then add the agenda part
 		if strings.HasPrefix(i.Link, "/") {
-			description.WriteString(agendaURLPrefix)
+			description.WriteString(t.linkPrefix())
 		}
 
 		description.WriteString(strings.Replace(i.Link, " ", "%20", -1))
@@ -167,41 +264,61 @@ func renderLink(i CalItem) string {
 	return description.String()
 }
 
-func renderLocation(o string) string {
+func renderLocation(t *tenant, o string) string {
 	lo := strings.ToLower(o)
 
 	if lo == "raadzaal" || lo == "commissiekamer" {
-		return fmt.Sprintf("%s, Stadhuis, Leiden", strings.Title(o))
+		return fmt.Sprintf("%s, %s", strings.Title(o), t.TownHall)
 	}
 
 	return o
 }
 
-func extractDocumentSet(sets []interface{}) []document {
+// extractDocumentSet returns the documents in a (nested) list of documents. Malformed documents
+// are skipped.
+func extractDocumentSet(ctx context.Context, id int, set json.RawMessage) []document {
 	docs := []document{}
 
-	for _, ds := range sets {
-		switch d := ds.(type) {
-		case []interface{}:
-			docs = append(docs, extractDocumentSet(d)...)
-		case map[string]interface{}:
-			docs = append(docs, extractDocument(d))
+	if len(set) == 0 || string(set) == "null" {
+		return docs
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(set, &entries); err != nil {
+		logger(ctx).Warn("Skipping malformed documents", "meeting", id, "err", err)
+		return docs
+	}
+
+	for _, e := range entries {
+		e = bytes.TrimSpace(e)
+		if len(e) > 0 && e[0] == '[' {
+			docs = append(docs, extractDocumentSet(ctx, id, e)...)
+			continue
+		}
+
+		d, err := extractDocument(e)
+		if err != nil {
+			logger(ctx).Warn("Skipping malformed document", "meeting", id, "err", err)
+			continue
 		}
+		docs = append(docs, d)
 	}
 	return docs
 }
 
-func extractDocument(d map[string]interface{}) document {
-	var url string
-
-	if u, ok := d["url"]; ok {
-		url = u.(string)
-	} else {
-		url = d["document_url"].(string)
+func extractDocument(raw json.RawMessage) (document, error) {
+	var d notubizDocument
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return document{}, fmt.Errorf("Unable to parse document [%s]: %+v", snippet(raw), err)
 	}
 
-	return document{
-		Title: d["title"].(string),
-		URL:   url,
+	url := d.URL
+	if url == "" {
+		url = d.DocumentURL
+	}
+	if url == "" {
+		return document{}, fmt.Errorf("Document [%s] has no URL!", snippet(raw))
 	}
+
+	return document{Title: d.Title, URL: url}, nil
 }
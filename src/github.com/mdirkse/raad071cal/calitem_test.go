@@ -15,6 +15,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"strings"
 	"testing"
@@ -37,7 +39,7 @@ func TestItemsShouldBeEnrichedCorrectly(t *testing.T) {
 	}
 
 	for _, i := range testSet {
-		result, _ := EnrichItem(i.input, GetTestTime())
+		result, _ := EnrichItem(context.Background(), GetTestTenant(), i.input, GetTestTime())
 		result.Documents = nil // reset to nil so we don't have to fake this in the expected struct as well
 		assert.Equal(t, i.expected, result, "Test item incorrectly parsed!")
 	}
@@ -47,7 +49,7 @@ func TestParseItemWithInvalidDateShouldYieldAnError(t *testing.T) {
 	tstInput := GetTestItem1()
 	tstInput.Date = "bladibla"
 
-	_, err := EnrichItem(tstInput, GetTestTime())
+	_, err := EnrichItem(context.Background(), GetTestTenant(), tstInput, GetTestTime())
 	assert.NotNil(t, err, "Faulty test item parsed when it shouldn't have been!")
 }
 
@@ -56,7 +58,7 @@ func TestVariousSpecialCasesForMeetingDuration(t *testing.T) {
 	gri := deEnrich(GetTestItem1())
 	gri.Description = "Gemeenteraad"
 	gri.Time = "16:00"
-	gr21, _ := EnrichItem(gri, GetTestTime())
+	gr21, _ := EnrichItem(context.Background(), GetTestTenant(), gri, GetTestTime())
 	if gr21.EndDateTime.Hour() != 21 {
 		t.Errorf("Gemeenteraad item has wrong end time. Expected 21 but was %d!", gr21.EndDateTime.Hour())
 	}
@@ -66,7 +68,7 @@ func TestVariousSpecialCasesForMeetingDuration(t *testing.T) {
 	ci := deEnrich(GetTestItem1())
 	ci.Description = "College Burgemeester en Wethouders"
 	ci.Time = "16:00"
-	col3h, _ := EnrichItem(ci, GetTestTime())
+	col3h, _ := EnrichItem(context.Background(), GetTestTenant(), ci, GetTestTime())
 	col3hDuration := col3h.EndDateTime.Sub(col3h.StartDateTime).Hours()
 	if col3hDuration != 3 {
 		t.Errorf("College lasted wrong amount of hours. Expected 3 but was %f!", col3hDuration)
@@ -92,10 +94,92 @@ func TestRenderItemShouldYieldCorrectICalEvent(t *testing.T) {
 	}
 }
 
+func TestRenderItemInUTCModeShouldYieldUTCTimes(t *testing.T) {
+	utcMode = true
+	defer func() {
+		utcMode = false
+	}()
+
+	var result bytes.Buffer
+	GetTestItem3().RenderItem(&result)
+
+	assert.Contains(t, result.String(), "\r\nDTSTART:20160623T180000Z\r\nDTEND:20160623T210000Z\r\n", "Item not rendered in UTC!")
+}
+
+func TestItemsWithoutIDShouldGetAHashedUID(t *testing.T) {
+	i := deEnrich(GetTestItem1())
+	i.ID = 0
+
+	result, _ := EnrichItem(context.Background(), GetTestTenant(), i, GetTestTime())
+	assert.Equal(t, "leiden-e058fd25aa867090dd7e25c9455d7156", result.UID, "Wrong fallback UID!")
+}
+
+func TestRenderItemShouldIncludeRevision(t *testing.T) {
+	i := GetTestItem3()
+	i.Sequence = 3
+	i.LastModified = GetTestTime().Add(time.Hour)
+
+	var result bytes.Buffer
+	i.RenderItem(&result)
+
+	assert.Contains(t, result.String(), "\r\nLAST-MODIFIED:20160623T150000Z\r\nSEQUENCE:3\r\n", "Revision incorrectly rendered!")
+}
+
+func TestCancelledItemsShouldBeRenderedAsCancelled(t *testing.T) {
+	i := GetTestItem3()
+	i.Canceled = true
+
+	var result bytes.Buffer
+	i.RenderItem(&result)
+	assert.Contains(t, result.String(), "\r\nSTATUS:CANCELLED\r\nSUMMARY:Raadscommissie Stedelijke Ontwikkeling\r\n", "Cancelled item incorrectly rendered!")
+
+	prefixCancelled = true
+	defer func() {
+		prefixCancelled = false
+	}()
+
+	result.Reset()
+	i.RenderItem(&result)
+	assert.Contains(t, result.String(), "\r\nSUMMARY:[GEANNULEERD] Raadscommissie Stedelijke Ontwikkeling\r\n", "Cancelled item not prefixed!")
+}
+
+func TestExpiredCancellationsShouldBeDropped(t *testing.T) {
+	now := GetTestTime()
+
+	recent := GetTestItem2()
+	recent.Canceled = true
+	recent.LastModified = now.Add(-24 * time.Hour)
+
+	expired := GetTestItem3()
+	expired.Canceled = true
+	expired.LastModified = now.Add(-15 * 24 * time.Hour)
+
+	// Changes after the cancellation don't count
+	changed := GetTestItem3()
+	changed.Canceled = true
+	changed.CanceledAt = now.Add(-15 * 24 * time.Hour)
+	changed.LastModified = now.Add(-time.Hour)
+
+	old := GetTestItem1()
+	old.LastModified = now.Add(-365 * 24 * time.Hour)
+
+	items := []CalItem{old, recent, expired, changed}
+
+	assert.Equal(t, items, dropExpiredCancellations(items, now, 0), "Items dropped without a grace period!")
+	assert.Equal(t, []CalItem{old, recent}, dropExpiredCancellations(items, now, 14*24*time.Hour), "Wrong items dropped!")
+}
+
+func TestRemovedItemsShouldBeDropped(t *testing.T) {
+	removed := GetTestItem2()
+	removed.Removed = true
+
+	assert.Equal(t, []CalItem{GetTestItem1(), GetTestItem3()}, dropRemoved([]CalItem{GetTestItem1(), removed, GetTestItem3()}), "Wrong items dropped!")
+}
+
 func deEnrich(i CalItem) CalItem {
 	i.UID = ""
 	i.AllDay = false
-	i.Link = strings.Replace(i.Link, agendaURLPrefix, "", 1)
+	i.Link = strings.Replace(i.Link, GetTestTenant().linkPrefix(), "", 1)
 	i.Location = strings.Split(i.Location, ",")[0]
 	i.CreatedDateTime = time.Time{}
 	i.StartDateTime = time.Time{}
@@ -106,14 +190,11 @@ func deEnrich(i CalItem) CalItem {
 	d[0] = unicode.ToLower(d[0])
 	i.Description = string(d)
 
-	var docs []interface{}
+	docs := []map[string]string{}
 	for _, d := range i.ExtractedDocuments {
-		m := make(map[string]interface{}, 2)
-		m["title"] = d.Title
-		m["url"] = d.URL
-		docs = append(docs, m)
+		docs = append(docs, map[string]string{"title": d.Title, "url": d.URL})
 	}
-	i.Documents = docs
+	i.Documents, _ = json.Marshal(docs)
 	i.ExtractedDocuments = []document{}
 
 	return i
@@ -123,7 +204,8 @@ func GetTestItem1() CalItem {
 	iTime := GetTestTime().Add(-14 * time.Hour)
 
 	return CalItem{
-		UID:                "e058fd25aa867090dd7e25c9455d7156",
+		ID:                 247977,
+		UID:                "leiden-247977",
 		AllDay:             true,
 		ExtractedDocuments: []document{},
 		Link:               "",
@@ -138,24 +220,26 @@ func GetTestItem1() CalItem {
 }
 
 func GetRenderedTestItem1() string {
-	return `BEGIN:VEVENT
-UID:e058fd25aa867090dd7e25c9455d7156@raad071.mdirkse.nl
+	return crlf(`BEGIN:VEVENT
+UID:leiden-247977@raad071.mdirkse.nl
 DTSTAMP:20160623T140000Z
+SEQUENCE:0
 DTSTART;VALUE=DATE:20160623
-DTEND;VALUE=DATE:20160623
+DTEND;VALUE=DATE:20160624
 SUMMARY:Einde zomerreces
-DESCRIPTION:
-LOCATION:
-END:VEVENT`
+END:VEVENT`)
 }
 
 func GetTestItem2() CalItem {
 	return CalItem{
-		UID:         "a2dc05212385ac8b98a4ded4e09e952c",
+		ID:          247981,
+		UID:         "leiden-247981",
 		AllDay:      false,
-		Link:        agendaURLPrefix + "/raad071cal.html",
+		Link:        GetTestTenant().linkPrefix() + "/raad071cal.html",
 		Location:    "Raadzaal, Stadhuis, Leiden",
 		Description: "Instructiebijeenkomst Raad071Cal",
+		CommitteeID: 994,
+		Committee:   category{994, "OS", "raadscommissie Onderwijs en Samenleving"},
 		ExtractedDocuments: []document{
 			{
 				Title: "iCal spec",
@@ -175,25 +259,32 @@ func GetTestItem2() CalItem {
 }
 
 func GetRenderedTestItem2() string {
-	return `BEGIN:VEVENT
-UID:a2dc05212385ac8b98a4ded4e09e952c@raad071.mdirkse.nl
+	return crlf(`BEGIN:VEVENT
+UID:leiden-247981@raad071.mdirkse.nl
 DTSTAMP:20160623T140000Z
-DTSTART:20160623T170000Z
-DTEND:20160623T190000Z
+SEQUENCE:0
+DTSTART;TZID=Europe/Amsterdam:20160623T190000
+DTEND;TZID=Europe/Amsterdam:20160623T210000
 SUMMARY:Instructiebijeenkomst Raad071Cal
-DESCRIPTION:Notubiz link: https://leiden.notubiz.nl/raad071cal.html\nDocuments:\n- iCal spec https://www.ietf.org/rfc/rfc2445.txt\n- History of the calendar https://en.wikipedia.org/wiki/Calendar\n
-LOCATION:Raadzaal, Stadhuis, Leiden
-END:VEVENT`
+DESCRIPTION:Notubiz link: https://leiden.notubiz.nl/raad071cal.html\nDocume
+ nts:\n- iCal spec https://www.ietf.org/rfc/rfc2445.txt\n- History of the c
+ alendar https://en.wikipedia.org/wiki/Calendar\n
+LOCATION:Raadzaal\, Stadhuis\, Leiden
+URL:https://leiden.notubiz.nl/raad071cal.html
+END:VEVENT`)
 }
 
 func GetTestItem3() CalItem {
 	return CalItem{
-		UID:                "7599ab178274a0adcbee1b7e80f72bed",
+		ID:                 247980,
+		UID:                "leiden-247980",
 		AllDay:             false,
 		ExtractedDocuments: []document{},
-		Link:               agendaURLPrefix + "/vergadering/247980/raadscommissie%20Stedelijke%20Ontwikkeling%2001-09-2016",
+		Link:               GetTestTenant().linkPrefix() + "/vergadering/247980/raadscommissie%20Stedelijke%20Ontwikkeling%2001-09-2016",
 		Location:           "Commissiekamer, Stadhuis, Leiden",
 		Description:        "Raadscommissie Stedelijke Ontwikkeling",
+		CommitteeID:        4366,
+		Committee:          category{4366, "SO", "raadscommissie Stedelijke Ontwikkeling"},
 		Date:               GetTestTime().Add(4 * time.Hour).Format(testDateFormat),
 		Time:               "20:00",
 		CreatedDateTime:    GetTestTime().In(time.UTC),
@@ -203,15 +294,28 @@ func GetTestItem3() CalItem {
 }
 
 func GetRenderedTestItem3() string {
-	return `BEGIN:VEVENT
-UID:7599ab178274a0adcbee1b7e80f72bed@raad071.mdirkse.nl
+	return crlf(`BEGIN:VEVENT
+UID:leiden-247980@raad071.mdirkse.nl
 DTSTAMP:20160623T140000Z
-DTSTART:20160623T180000Z
-DTEND:20160623T210000Z
+SEQUENCE:0
+DTSTART;TZID=Europe/Amsterdam:20160623T200000
+DTEND;TZID=Europe/Amsterdam:20160623T230000
 SUMMARY:Raadscommissie Stedelijke Ontwikkeling
-DESCRIPTION:Notubiz link: https://leiden.notubiz.nl/vergadering/247980/raadscommissie%20Stedelijke%20Ontwikkeling%2001-09-2016\n
-LOCATION:Commissiekamer, Stadhuis, Leiden
-END:VEVENT`
+DESCRIPTION:Notubiz link: https://leiden.notubiz.nl/vergadering/247980/raad
+ scommissie%20Stedelijke%20Ontwikkeling%2001-09-2016\n
+LOCATION:Commissiekamer\, Stadhuis\, Leiden
+URL:https://leiden.notubiz.nl/vergadering/247980/raadscommissie%20Stedelijk
+ e%20Ontwikkeling%2001-09-2016
+END:VEVENT`)
+}
+
+// crlf turns a multi-line string literal into iCalendar content lines.
+func crlf(s string) string {
+	return strings.Replace(s, "\n", "\r\n", -1) + "\r\n"
+}
+
+func GetTestTenant() *tenant {
+	return newTenant(defaultTenant)
 }
 
 func GetTestTime() time.Time {
@@ -0,0 +1,150 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const committeeIndexSrc = `<!DOCTYPE html>
+<html lang="nl">
+<head>
+<meta charset="utf-8">
+<title>{{.Feed.Name}} - commissies</title>
+</head>
+<body>
+<h1>{{.Feed.Name}}</h1>
+<p>{{.Feed.Description}}: <a href="{{.Feed.URL}}">{{.Feed.URL}}</a></p>
+<h2>Commissies</h2>
+<ul>
+{{- range .Committees}}
+<li><a href="{{.URL}}">{{.Long}} ({{.Short}})</a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`
+
+var committeeIndexTemplate = template.Must(template.New("committees").Parse(committeeIndexSrc))
+
+// category is a Notubiz meeting category. Most of these are council committees,
+// the meetings refer to them through their "commissie" id.
+type category struct {
+	ID    int    `json:"id"`
+	Short string `json:"short"`
+	Long  string `json:"long"`
+}
+
+type committeeLink struct {
+	category
+	URL string
+}
+
+// committees returns the distinct committees of the given items, sorted by their short name.
+func committees(items []CalItem) []category {
+	seen := make(map[int]bool)
+	cs := []category{}
+
+	for _, i := range items {
+		if i.Committee.ID == 0 || seen[i.Committee.ID] {
+			continue
+		}
+		seen[i.Committee.ID] = true
+		cs = append(cs, i.Committee)
+	}
+
+	sort.Slice(cs, func(a, b int) bool { return cs[a].Short < cs[b].Short })
+
+	return cs
+}
+
+// committeeItems returns the items that belong to the committee with the given short name.
+func committeeItems(items []CalItem, short string) []CalItem {
+	var cis []CalItem
+
+	for _, i := range items {
+		if i.Committee.ID != 0 && strings.EqualFold(i.Committee.Short, short) {
+			cis = append(cis, i)
+		}
+	}
+
+	return cis
+}
+
+// committeeURL returns the URL of the feed of the committee. The short name comes from Notubiz,
+// so it is escaped.
+func (t *tenant) committeeURL(c category) string {
+	return fmt.Sprintf("%s/%s/commissie/%s.ics", feedURLPrefix, t.Name, url.PathEscape(strings.ToLower(c.Short)))
+}
+
+func (t *tenant) committeeFeed(c category) feed {
+	return feed{
+		URL:         t.committeeURL(c),
+		Name:        fmt.Sprintf("%s - %s", t.CalName, c.Short),
+		Description: fmt.Sprintf("%s: %s", t.CalDesc, c.Long),
+	}
+}
+
+// committeeHandler serves the committee index on the prefix itself and a feed per
+// committee on {prefix}{short}.ics.
+func committeeHandler(t *tenant, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		s := t.snapshot()
+		items := s.items
+
+		if name == "" {
+			t.serveFeed(w, r, s, "commissie/", "text/html; charset=utf-8", func(w io.Writer) error {
+				return renderCommitteeIndex(t, items, w)
+			})
+			return
+		}
+
+		if !strings.HasSuffix(name, ".ics") {
+			http.NotFound(w, r)
+			return
+		}
+		short := strings.TrimSuffix(name, ".ics")
+
+		for _, c := range committees(items) {
+			if strings.EqualFold(c.Short, short) {
+				c := c
+				t.serveFeed(w, r, s, "commissie/"+strings.ToLower(short)+".ics", "text/calendar", func(w io.Writer) error {
+					return renderCalendar(t.committeeFeed(c), committeeItems(items, short), w)
+				})
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+	})
+}
+
+func renderCommitteeIndex(t *tenant, items []CalItem, w io.Writer) error {
+	var links []committeeLink
+	for _, c := range committees(items) {
+		links = append(links, committeeLink{category: c, URL: t.committeeURL(c)})
+	}
+
+	return committeeIndexTemplate.Execute(w, struct {
+		Feed       feed
+		Committees []committeeLink
+	}{t.feed(), links})
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testCommitteePrefix = "/kalender/leiden/commissie/"
+
+func getTestCommitteeTenant() *tenant {
+	tt := GetTestTenant()
+	tt.setCalItems([]CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()})
+	return tt
+}
+
+func TestCommitteesShouldBeDistinctAndSorted(t *testing.T) {
+	items := []CalItem{GetTestItem3(), GetTestItem1(), GetTestItem2(), GetTestItem3()}
+
+	expected := []category{
+		{994, "OS", "raadscommissie Onderwijs en Samenleving"},
+		{4366, "SO", "raadscommissie Stedelijke Ontwikkeling"},
+	}
+
+	assert.Equal(t, expected, committees(items), "Wrong committees extracted!")
+}
+
+func TestCommitteeItemsShouldOnlyYieldItemsOfThatCommittee(t *testing.T) {
+	items := []CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()}
+
+	assert.Equal(t, []CalItem{GetTestItem3()}, committeeItems(items, "so"), "Wrong committee items selected!")
+	assert.Nil(t, committeeItems(items, "RAAD"), "Items selected for an absent committee!")
+}
+
+func TestCommitteeEndpointShouldServeCommitteeFeed(t *testing.T) {
+	tt := getTestCommitteeTenant()
+	req, _ := http.NewRequest("GET", testCommitteePrefix+"SO.ics", nil)
+	w := httptest.NewRecorder()
+	committeeHandler(tt, testCommitteePrefix).ServeHTTP(w, req)
+
+	so := category{4366, "SO", "raadscommissie Stedelijke Ontwikkeling"}
+	var expected bytes.Buffer
+	renderCalendar(tt.committeeFeed(so), []CalItem{GetTestItem3()}, &expected)
+
+	assert.Equal(t, 200, w.Code, "Request returned incorrect status!")
+	assert.Equal(t, "text/calendar", w.Header().Get("Content-Type"), "Wrong content type!")
+	assert.Equal(t, expected.String(), w.Body.String(), "Committee feed went awry!")
+}
+
+func TestCommitteeEndpointShouldServeIndex(t *testing.T) {
+	req, _ := http.NewRequest("GET", testCommitteePrefix, nil)
+	w := httptest.NewRecorder()
+	committeeHandler(getTestCommitteeTenant(), testCommitteePrefix).ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code, "Request returned incorrect status!")
+	assert.Contains(t, w.Body.String(), `<a href="http://raad071.mdirkse.nl/kalender/leiden/commissie/os.ics">raadscommissie Onderwijs en Samenleving (OS)</a>`)
+	assert.Contains(t, w.Body.String(), `<a href="http://raad071.mdirkse.nl/kalender/leiden/commissie/so.ics">raadscommissie Stedelijke Ontwikkeling (SO)</a>`)
+}
+
+func TestCommitteeURLShouldBeEscaped(t *testing.T) {
+	c := category{1, "R&O/X Y", "raadscommissie Ruimte"}
+	assert.Equal(t, "http://raad071.mdirkse.nl/kalender/leiden/commissie/r&o%2Fx%20y.ics", GetTestTenant().committeeURL(c), "Committee URL not escaped!")
+}
+
+func TestCommitteeEndpointShouldReturn404ForUnknownCommittees(t *testing.T) {
+	for _, p := range []string{"RAAD.ics", "SO", "SO.ics/bla"} {
+		req, _ := http.NewRequest("GET", testCommitteePrefix+p, nil)
+		w := httptest.NewRecorder()
+		committeeHandler(getTestCommitteeTenant(), testCommitteePrefix).ServeHTTP(w, req)
+
+		assert.Equal(t, 404, w.Code, "Request for [%s] returned incorrect status!", p)
+	}
+}
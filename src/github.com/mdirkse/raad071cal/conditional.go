@@ -0,0 +1,106 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// enrichVersion is part of the enrichment fingerprint. Increase it when EnrichItem changes, so
+// that the stored months are parsed again.
+const enrichVersion = 1
+
+// monthValidator identifies the last version of a month that was fetched and stored. It's used
+// to skip months that haven't changed upstream, and is kept in the store so that this also
+// works for the first poll after a restart.
+type monthValidator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Hash         string `json:"hash,omitempty"`   // of the JSON body
+	Enrich       string `json:"enrich,omitempty"` // the enrichment fingerprint of the stored items
+}
+
+// setRequestHeaders turns the request into a conditional one.
+func (v monthValidator) setRequestHeaders(req *http.Request) {
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// update returns the validator for a response to a request made with this validator.
+func (v monthValidator) update(h http.Header, notModified bool) monthValidator {
+	if etag := h.Get("ETag"); etag != "" || !notModified {
+		v.ETag = etag
+	}
+	if lm := h.Get("Last-Modified"); lm != "" || !notModified {
+		v.LastModified = lm
+	}
+	return v
+}
+
+// enrichFingerprint identifies what EnrichItem adds to the meetings besides the Notubiz response:
+// the settings of the tenant that it uses and enrichVersion. Months that were stored with another
+// fingerprint are fetched and parsed again.
+func (t *tenant) enrichFingerprint() string {
+	return hashBody(fmt.Sprintf("%d|%s|%s|%s", enrichVersion, t.Name, t.linkPrefix(), t.TownHall))
+}
+
+func hashBody(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *tenant) monthValidator(ym yearMonth) monthValidator {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.validators[ym]
+}
+
+// monthValidators returns the validators of the months that were fetched successfully. A month in
+// which meetings were skipped gets an empty validator, so it is fetched and parsed again.
+func monthValidators(results []monthResult) map[yearMonth]monthValidator {
+	vs := make(map[yearMonth]monthValidator)
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+
+		v := r.validator
+		if r.skipped > 0 {
+			v = monthValidator{}
+		}
+		vs[r.month] = v
+	}
+	return vs
+}
+
+// setMonthValidators remembers the validators of months. Call it only once the months have
+// been stored, so that a failed store is fetched again.
+func (t *tenant) setMonthValidators(validators map[yearMonth]monthValidator) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.validators == nil {
+		t.validators = make(map[yearMonth]monthValidator)
+	}
+	for ym, v := range validators {
+		t.validators[ym] = v
+	}
+}
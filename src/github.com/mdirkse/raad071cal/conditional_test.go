@@ -0,0 +1,123 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMonthValidatorUpdate(t *testing.T) {
+	prev := monthValidator{ETag: `"a"`, LastModified: "Wed, 22 Jun 2016 10:00:00 GMT", Hash: "x"}
+
+	assert.Equal(t, prev, prev.update(http.Header{}, true), "Validator of an unmodified month changed!")
+
+	h := http.Header{}
+	h.Set("ETag", `"b"`)
+	assert.Equal(t, monthValidator{ETag: `"b"`, Hash: "x"}, prev.update(h, false), "Wrong validator for a modified month!")
+}
+
+func TestUnmodifiedMonthsShouldNotBeParsed(t *testing.T) {
+	var conditional int32
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		etag := fmt.Sprintf(`"%s"`, ym)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `callback_function({"success": true, "meetings": []})`)
+	})
+	defer srv.Close()
+
+	results := fetchCalendarItems(context.Background(), tt, GetTestTime())
+	assert.Equal(t, 0, newPollStatus(GetTestTime(), results).Unchanged, "Months unchanged on the first poll!")
+	assert.Equal(t, `"2016-01"`, results[0].validator.ETag, "ETag not kept!")
+
+	tt.setMonthValidators(monthValidators(results))
+	results = fetchCalendarItems(context.Background(), tt, GetTestTime())
+
+	assert.Equal(t, int32(generatedMonths), atomic.LoadInt32(&conditional), "Requests were not conditional!")
+	assert.Equal(t, generatedMonths, newPollStatus(GetTestTime(), results).Unchanged, "Unmodified months were not skipped!")
+	assert.Equal(t, `"2016-01"`, results[0].validator.ETag, "ETag lost on an unmodified month!")
+}
+
+func TestMonthsWithTheSameContentShouldNotBeParsed(t *testing.T) {
+	serve := serveTestFile("../../../../testfiles/tst.json")
+	changed := yearMonth{}
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if ym == changed {
+			fmt.Fprintf(w, `callback_function({"success": true, "meetings": []})`)
+			return
+		}
+		serve(w, r, ym)
+	})
+	defer srv.Close()
+
+	tt.setMonthValidators(monthValidators(fetchCalendarItems(context.Background(), tt, GetTestTime())))
+
+	changed = yearMonth{2016, 8}
+	results := fetchCalendarItems(context.Background(), tt, GetTestTime())
+	items, months, err := splitMonthResults(results)
+
+	assert.Nil(t, err, "Unable to fetch calendar items!")
+	assert.Equal(t, []yearMonth{changed}, months, "Only the changed month should be replaced!")
+	assert.Empty(t, items, "Items of unchanged months were parsed!")
+	assert.Equal(t, generatedMonths-1, newPollStatus(GetTestTime(), results).Unchanged, "Wrong amount of unchanged months!")
+}
+
+func TestMonthsShouldBeParsedAgainWhenTheEnrichmentChanges(t *testing.T) {
+	var conditional int32
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if r.Header.Get("If-None-Match") != "" {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"a"`)
+		fmt.Fprintf(w, `callback_function({"success": true, "meetings": []})`)
+	})
+	defer srv.Close()
+
+	tt.setMonthValidators(monthValidators(fetchCalendarItems(context.Background(), tt, GetTestTime())))
+
+	tt.TownHall = "Stadhuis, Stadhuisplein 1, Leiden"
+	results := fetchCalendarItems(context.Background(), tt, GetTestTime())
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&conditional), "Requests were conditional!")
+	assert.Equal(t, 0, newPollStatus(GetTestTime(), results).Unchanged, "Months with another enrichment were skipped!")
+	assert.Equal(t, tt.enrichFingerprint(), results[0].validator.Enrich, "Enrichment fingerprint not kept!")
+}
+
+func TestUnchangedPollShouldKeepTheFeed(t *testing.T) {
+	store = newMemoryStore()
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		fmt.Fprintf(w, `callback_function({"success": true, "meetings": [{"id": %d%02d, "canceled": false, "description": "Gemeenteraad", "location": "", "documents": [], "date": "15-%02d-%d", "time": "20:00"}]})`, ym.year, ym.month, ym.month, ym.year)
+	})
+	defer srv.Close()
+
+	loadCalendarItems(context.Background(), tt)
+	before := tt.calItems()
+	loadCalendarItems(context.Background(), tt)
+
+	assert.NotEmpty(t, before, "Nothing loaded!")
+	assert.Equal(t, before, tt.calItems(), "Unchanged poll changed the feed!")
+	assert.Equal(t, generatedMonths, tt.pollStatus().Unchanged, "Poll was not unchanged!")
+	assert.False(t, tt.pollStatus().Abandoned, "Unchanged poll was abandoned!")
+}
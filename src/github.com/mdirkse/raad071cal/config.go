@@ -0,0 +1,395 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/robfig/cron"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	envPrefix  = "RAAD071CAL_"
+	configFlag = "config"
+)
+
+// config holds all settings. They are read from (in order of precedence) the command line, the
+// environment (RAAD071CAL_{FLAG}, eg. RAAD071CAL_FETCH_TIMEOUT) and the config file.
+type config struct {
+	Listen           string     `yaml:"listen"`
+	DataDir          string     `yaml:"data_dir"`
+	Gemeenten        stringList `yaml:"gemeenten"`
+	FeedURLPrefix    string     `yaml:"feed_url_prefix"`
+	UTC              bool       `yaml:"utc"`
+	CancelledPrefix  bool       `yaml:"cancelled_prefix"`
+	CancelledGrace   duration   `yaml:"cancelled_grace"`
+	Filter           string     `yaml:"filter"` // applied to every feed, eg. exclude=presidium
+	FeedMonthsBack   int        `yaml:"feed_months_back"`
+	FeedMonthsAhead  int        `yaml:"feed_months_ahead"`
+	FetchMonthsBack  int        `yaml:"fetch_months_back"`
+	FetchMonthsAhead int        `yaml:"fetch_months_ahead"`
+	FetchTimeout     duration   `yaml:"fetch_timeout"`
+	FetchRetries     int        `yaml:"fetch_retries"`
+	FetchConcurrency int        `yaml:"fetch_concurrency"`
+	FetchRate        float64    `yaml:"fetch_rate"`
+	FetchBurst       int        `yaml:"fetch_burst"`
+	MaxDataAge       duration   `yaml:"max_data_age"`
+	AdminToken       string     `yaml:"admin_token"` // enables /admin, use the environment rather than a flag
+	ShutdownTimeout  duration   `yaml:"shutdown_timeout"`
+	LogLevel         string     `yaml:"log_level"`  // debug, info, warn or error
+	LogFormat        string     `yaml:"log_format"` // text or json
+
+	// Tenants overrides the metadata of known tenants and defines new ones. Only the tenants
+	// in Gemeenten are served.
+	Tenants map[string]tenantInfo `yaml:"tenants"`
+}
+
+// newConfig returns the configuration with the built-in defaults.
+func newConfig() *config {
+	return &config{
+		Listen:           listenAddress,
+		DataDir:          "data",
+		Gemeenten:        stringList{defaultTenant},
+		FeedURLPrefix:    feedURLPrefix,
+		CancelledGrace:   duration(cancelledGrace),
+		FeedMonthsBack:   feedMonthsBack,
+		FeedMonthsAhead:  feedMonthsAhead,
+		FetchMonthsBack:  fetchMonthsBack,
+		FetchMonthsAhead: fetchMonthsAhead,
+		FetchTimeout:     duration(fetchTimeout),
+		FetchRetries:     fetchRetries,
+		FetchConcurrency: fetchConcurrency,
+		FetchRate:        fetchRate,
+		FetchBurst:       fetchBurst,
+		MaxDataAge:       duration(maxDataAge),
+		ShutdownTimeout:  duration(shutdownTimeout),
+		LogLevel:         logLevel,
+		LogFormat:        logFormat,
+	}
+}
+
+// parseConfig reads the config file, environment and command line. Flags that are not part of
+// the configuration should be defined on fs before calling it.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	cfg := newConfig()
+
+	path := configPath(args)
+	if path != "" {
+		if err := cfg.load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.String(configFlag, path, "YAML file to read the configuration from.")
+	cfg.registerFlags(fs)
+
+	// Environment variables override the file, flags override the environment
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == configFlag || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			envErr = fmt.Errorf("Invalid value [%s] for %s: %+v", v, envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// configPath finds the config file in the arguments or the environment.
+func configPath(args []string) string {
+	path := os.Getenv(envName(configFlag))
+
+	for n, a := range args {
+		a = strings.TrimLeft(a, "-")
+		if a == configFlag && n+1 < len(args) {
+			path = args[n+1]
+		} else if strings.HasPrefix(a, configFlag+"=") {
+			path = strings.TrimPrefix(a, configFlag+"=")
+		}
+	}
+
+	return path
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func (c *config) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read config file [%s]: %+v", path, err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("Unable to parse config file [%s]: %+v", path, err)
+	}
+
+	return nil
+}
+
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Address to listen on.")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "Directory in which all meetings are stored. Leave empty to keep them in memory only.")
+	fs.Var(&c.Gemeenten, "gemeenten", "Comma separated list of the Notubiz tenants to serve calendars for.")
+	fs.StringVar(&c.FeedURLPrefix, "feed-url-prefix", c.FeedURLPrefix, "Public URL under which the feeds are served.")
+	fs.BoolVar(&c.UTC, "utc", c.UTC, "Render event times in UTC instead of local time with a VTIMEZONE.")
+	fs.BoolVar(&c.CancelledPrefix, "cancelled-prefix", c.CancelledPrefix, "Prefix the title of cancelled meetings with "+cancelledPrefix+".")
+	fs.Var(&c.CancelledGrace, "cancelled-grace", "Remove cancelled meetings from the feed after this period (eg. 336h). 0 keeps them.")
+	fs.StringVar(&c.Filter, "filter", c.Filter, "Filter applied to every feed, in query string form (eg. exclude=presidium).")
+	fs.IntVar(&c.FeedMonthsBack, "feed-months-back", c.FeedMonthsBack, "Number of past months that are shown in the feeds.")
+	fs.IntVar(&c.FeedMonthsAhead, "feed-months-ahead", c.FeedMonthsAhead, "Number of future months that are shown in the feeds.")
+	fs.IntVar(&c.FetchMonthsBack, "fetch-months-back", c.FetchMonthsBack, "Number of past months that are fetched from Notubiz on every poll.")
+	fs.IntVar(&c.FetchMonthsAhead, "fetch-months-ahead", c.FetchMonthsAhead, "Number of future months that are fetched from Notubiz on every poll.")
+	fs.Var(&c.FetchTimeout, "fetch-timeout", "Timeout of a single request to Notubiz.")
+	fs.IntVar(&c.FetchRetries, "fetch-retries", c.FetchRetries, "Number of retries of a failed request to Notubiz.")
+	fs.IntVar(&c.FetchConcurrency, "fetch-concurrency", c.FetchConcurrency, "Number of months of a tenant that are fetched at the same time.")
+	fs.Float64Var(&c.FetchRate, "fetch-rate", c.FetchRate, "Maximum number of requests per second to Notubiz, for all tenants together. 0 disables the limit.")
+	fs.IntVar(&c.FetchBurst, "fetch-burst", c.FetchBurst, "Number of requests to Notubiz that may be done at once after a quiet period.")
+	fs.Var(&c.MaxDataAge, "max-data-age", "Maximum age of the last successful poll of every tenant for /readyz to report ready.")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Bearer token for the /admin endpoints, which are disabled without one.")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "How long in-flight requests and polls get to finish after a SIGTERM.")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Minimum level of the lines that are logged: debug, info, warn or error.")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Format of the log lines: text or json.")
+}
+
+// validate checks all settings and reports every problem it finds.
+func (c *config) validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Listen != "", "listen must not be empty")
+	check(isHTTPURL(c.FeedURLPrefix), "feed_url_prefix [%s] is not an http(s) URL", c.FeedURLPrefix)
+	check(c.CancelledGrace >= 0, "cancelled_grace must not be negative")
+	check(c.FeedMonthsBack >= 0 && c.FeedMonthsAhead >= 0, "feed_months_back and feed_months_ahead must not be negative")
+	check(c.FetchMonthsBack >= 0 && c.FetchMonthsAhead >= 0, "fetch_months_back and fetch_months_ahead must not be negative")
+	check(c.FetchTimeout > 0, "fetch_timeout must be positive")
+	check(c.FetchRetries >= 0, "fetch_retries must not be negative")
+	check(c.FetchConcurrency >= 1, "fetch_concurrency must be at least 1")
+	check(c.FetchRate >= 0, "fetch_rate must not be negative")
+	check(c.FetchBurst >= 1, "fetch_burst must be at least 1")
+	check(c.MaxDataAge > 0, "max_data_age must be positive")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	_, err := newLogHandler(ioutil.Discard, c.LogFormat, c.LogLevel)
+	check(err == nil, "log_level or log_format is invalid: %v", err)
+
+	if c.Filter != "" {
+		v, err := url.ParseQuery(c.Filter)
+		if err == nil {
+			_, err = parseItemFilter(v)
+		}
+		check(err == nil, "filter [%s] is invalid: %v", c.Filter, err)
+	}
+
+	ts, err := c.tenants()
+	check(err == nil, "gemeenten: %v", err)
+	for _, t := range ts {
+		_, err := cron.Parse(t.PollSpec)
+		check(err == nil, "tenants.%s.poll_spec [%s] is invalid: %v", t.Name, t.PollSpec, err)
+		check(t.Host != "", "tenants.%s.host must not be empty", t.Name)
+		check(t.APIBase == "" || isHTTPURL(t.APIBase), "tenants.%s.api_base [%s] is not an http(s) URL", t.Name, t.APIBase)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid configuration:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// tenants returns the tenants to serve, with the metadata from the config file applied.
+func (c *config) tenants() ([]*tenant, error) {
+	ts, err := parseTenants(strings.Join(c.Gemeenten, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range ts {
+		if ti, ok := c.Tenants[t.Name]; ok {
+			t.tenantInfo = mergeTenantInfo(t.tenantInfo, ti)
+		}
+	}
+
+	return ts, nil
+}
+
+// mergeTenantInfo overrides the fields of ti that are set in o.
+func mergeTenantInfo(ti tenantInfo, o tenantInfo) tenantInfo {
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&ti.Host, o.Host},
+		{&ti.APIBase, o.APIBase},
+		{&ti.CalName, o.CalName},
+		{&ti.CalDesc, o.CalDesc},
+		{&ti.TownHall, o.TownHall},
+		{&ti.PollSpec, o.PollSpec},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+	return ti
+}
+
+// apply sets the package level settings from the configuration.
+func (c *config) apply() {
+	listenAddress = c.Listen
+	feedURLPrefix = strings.TrimRight(c.FeedURLPrefix, "/")
+	utcMode = c.UTC
+	prefixCancelled = c.CancelledPrefix
+	cancelledGrace = time.Duration(c.CancelledGrace)
+	feedMonthsBack = c.FeedMonthsBack
+	feedMonthsAhead = c.FeedMonthsAhead
+	fetchMonthsBack = c.FetchMonthsBack
+	fetchMonthsAhead = c.FetchMonthsAhead
+	fetchTimeout = time.Duration(c.FetchTimeout)
+	fetchRetries = c.FetchRetries
+	fetchConcurrency = c.FetchConcurrency
+	fetchRate = c.FetchRate
+	fetchBurst = c.FetchBurst
+	notubizLimiter = newRateLimiter(fetchRate, fetchBurst)
+	adminToken = c.AdminToken
+	maxDataAge = time.Duration(c.MaxDataAge)
+	shutdownTimeout = time.Duration(c.ShutdownTimeout)
+
+	// Also makes the standard log package write through slog
+	if h, err := newLogHandler(os.Stderr, c.LogFormat, c.LogLevel); err == nil {
+		slog.SetDefault(slog.New(h))
+	}
+
+	feedFilter = itemFilter{}
+	if v, err := url.ParseQuery(c.Filter); err == nil {
+		feedFilter, _ = parseItemFilter(v) // validated already
+	}
+}
+
+// print writes the effective configuration as YAML, including the metadata of the tenants that
+// are served.
+func (c *config) print(w io.Writer) error {
+	out := *c
+	out.Tenants = make(map[string]tenantInfo)
+	if out.AdminToken != "" {
+		out.AdminToken = "********"
+	}
+
+	ts, err := c.tenants()
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		out.Tenants[t.Name] = t.tenantInfo
+	}
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return fmt.Errorf("Unable to encode the configuration: %+v", err)
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// runConfig implements the config subcommand.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("Usage: raad071cal config print [flags]")
+	}
+
+	cfg, err := parseConfig(flag.NewFlagSet("config print", flag.ExitOnError), args[1:])
+	if err != nil {
+		return err
+	}
+
+	return cfg.print(os.Stdout)
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// stringList is a list that is comma separated on the command line.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// duration is a time.Duration that is written as eg. 30s in the config file.
+type duration time.Duration
+
+func (d *duration) String() string {
+	if d == nil {
+		return "0s"
+	}
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(v string) error {
+	pd, err := time.ParseDuration(v)
+	*d = duration(pd)
+	return err
+}
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
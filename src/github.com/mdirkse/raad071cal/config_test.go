@@ -0,0 +1,185 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "raad071cal-config")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %+v", err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(path, []byte(content), 0644)
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+func TestDefaultConfigShouldBeValid(t *testing.T) {
+	cfg, err := parseConfig(testFlagSet(), nil)
+
+	assert.Nil(t, err, "Default configuration is invalid!")
+	assert.Equal(t, ":80", cfg.Listen, "Wrong default listen address!")
+	assert.Equal(t, stringList{"leiden"}, cfg.Gemeenten, "Wrong default tenants!")
+	assert.Equal(t, duration(30*time.Second), cfg.FetchTimeout, "Wrong default fetch timeout!")
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `
+listen: ":8080"
+fetch_timeout: 10s
+fetch_retries: 5
+feed_months_back: 2
+gemeenten: [leiden, oegstgeest]
+`)
+	defer cleanup()
+
+	os.Setenv("RAAD071CAL_FETCH_RETRIES", "1")
+	os.Setenv("RAAD071CAL_FEED_MONTHS_BACK", "3")
+	defer os.Unsetenv("RAAD071CAL_FETCH_RETRIES")
+	defer os.Unsetenv("RAAD071CAL_FEED_MONTHS_BACK")
+
+	cfg, err := parseConfig(testFlagSet(), []string{"-config", path, "-feed-months-back", "4"})
+
+	if assert.Nil(t, err, "Unable to parse the configuration!") {
+		assert.Equal(t, ":8080", cfg.Listen, "File setting not used!")
+		assert.Equal(t, duration(10*time.Second), cfg.FetchTimeout, "File duration not used!")
+		assert.Equal(t, 1, cfg.FetchRetries, "Environment doesn't override the file!")
+		assert.Equal(t, 4, cfg.FeedMonthsBack, "Flag doesn't override the environment!")
+		assert.Equal(t, stringList{"leiden", "oegstgeest"}, cfg.Gemeenten, "Wrong tenants!")
+	}
+}
+
+func TestConfigFileFromEnvironment(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `listen: ":8081"`)
+	defer cleanup()
+
+	os.Setenv("RAAD071CAL_CONFIG", path)
+	defer os.Unsetenv("RAAD071CAL_CONFIG")
+
+	cfg, err := parseConfig(testFlagSet(), nil)
+
+	assert.Nil(t, err, "Unable to parse the configuration!")
+	assert.Equal(t, ":8081", cfg.Listen, "Config file from the environment not used!")
+}
+
+func TestConfigShouldRejectUnknownSettings(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `listen_address: ":8080"`)
+	defer cleanup()
+
+	_, err := parseConfig(testFlagSet(), []string{"-config=" + path})
+	assert.NotNil(t, err, "Unknown setting was accepted!")
+
+	os.Setenv("RAAD071CAL_FETCH_TIMEOUT", "lang")
+	defer os.Unsetenv("RAAD071CAL_FETCH_TIMEOUT")
+	_, err = parseConfig(testFlagSet(), nil)
+	if assert.NotNil(t, err, "Invalid environment variable was accepted!") {
+		assert.Contains(t, err.Error(), "RAAD071CAL_FETCH_TIMEOUT", "Error doesn't mention the variable!")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `
+feed_url_prefix: raad071.mdirkse.nl
+feed_months_back: -1
+fetch_concurrency: 0
+filter: "exclude=presidium&kleur=rood"
+gemeenten: [leiden]
+tenants:
+  leiden:
+    poll_spec: "elke zes uur"
+    api_base: "ftp://notubiz"
+`)
+	defer cleanup()
+
+	_, err := parseConfig(testFlagSet(), []string{"-config", path})
+
+	if assert.NotNil(t, err, "Invalid configuration was accepted!") {
+		for _, msg := range []string{"feed_url_prefix", "feed_months_back", "fetch_concurrency", "filter", "tenants.leiden.poll_spec", "tenants.leiden.api_base"} {
+			assert.Contains(t, err.Error(), msg, "Problem not reported!")
+		}
+	}
+}
+
+func TestConfigTenantsShouldOverrideKnownTenants(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `
+gemeenten: [leiden, katwijk]
+tenants:
+  leiden:
+    api_base: "http://notubiz-mock:8080"
+    poll_spec: "1 */5 * * * *"
+  katwijk:
+    host: katwijk.notubiz.nl
+    cal_name: "Katwijk"
+    cal_desc: "De agenda van Katwijk"
+    town_hall: "Raadhuis, Katwijk"
+`)
+	defer cleanup()
+
+	cfg, err := parseConfig(testFlagSet(), []string{"-config", path})
+	if !assert.Nil(t, err, "Unable to parse the configuration!") {
+		return
+	}
+
+	ts, err := cfg.tenants()
+	if assert.Nil(t, err, "Unable to get the tenants!") && assert.Equal(t, 2, len(ts), "Wrong amount of tenants!") {
+		assert.Equal(t, "http://notubiz-mock:8080", ts[0].APIBase, "API base not overridden!")
+		assert.Equal(t, "1 */5 * * * *", ts[0].PollSpec, "Poll spec not overridden!")
+		assert.Equal(t, "#raad071 kalender", ts[0].CalName, "Known metadata lost!")
+		assert.Equal(t, "Katwijk", ts[1].CalName, "New tenant not configured!")
+		assert.Equal(t, defaultPollSpec, ts[1].PollSpec, "New tenant has no default poll spec!")
+	}
+}
+
+func TestConfigPrintShouldRoundTrip(t *testing.T) {
+	cfg, _ := parseConfig(testFlagSet(), []string{"-gemeenten", "leiden,oegstgeest", "-cancelled-grace", "336h"})
+
+	var out bytes.Buffer
+	err := cfg.print(&out)
+	assert.Nil(t, err, "Unable to print the configuration!")
+	assert.Contains(t, out.String(), "cancelled_grace: 336h0m0s", "Duration not printed as a duration!")
+	assert.Contains(t, out.String(), "oegstgeest:", "Tenant metadata not printed!")
+
+	printed := newConfig()
+	assert.Nil(t, yaml.UnmarshalStrict(out.Bytes(), printed), "Printed configuration can't be read back!")
+	assert.Equal(t, cfg.CancelledGrace, printed.CancelledGrace, "Printed configuration is different!")
+	assert.Equal(t, cfg.Gemeenten, printed.Gemeenten, "Printed configuration is different!")
+}
+
+func TestConfigApply(t *testing.T) {
+	defer func(l *rateLimiter, f itemFilter, back int, ahead int) {
+		notubizLimiter, feedFilter, fetchMonthsBack, fetchMonthsAhead = l, f, back, ahead
+	}(notubizLimiter, feedFilter, fetchMonthsBack, fetchMonthsAhead)
+
+	cfg, _ := parseConfig(testFlagSet(), []string{"-filter", "exclude=presidium", "-fetch-months-back", "1", "-fetch-months-ahead", "2", "-fetch-rate", "0"})
+	cfg.apply()
+
+	assert.Equal(t, []string{"presidium"}, feedFilter.exclude, "Feed filter not applied!")
+	assert.Equal(t, []yearMonth{{2016, 5}, {2016, 6}, {2016, 7}, {2016, 8}}, generateMonthYearRange(GetTestTime()), "Fetch window not applied!")
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	eventPrefix   = "/kalender/event/"
+	meetingPrefix = "/vergadering/"
+)
+
+const meetingPageSrc = `<!DOCTYPE html>
+<html lang="nl">
+<head>
+<meta charset="utf-8">
+<title>{{.Item.Description}} - {{.Feed.Name}}</title>
+</head>
+<body>
+<h1>{{if .Item.Removed}}<del>{{.Item.Description}}</del> (verwijderd){{else if .Item.Canceled}}<del>{{.Item.Description}}</del> (geannuleerd){{else}}{{.Item.Description}}{{end}}</h1>
+<dl>
+<dt>Wanneer</dt>
+<dd>{{.When}}</dd>
+{{- if .Item.Location}}
+<dt>Waar</dt>
+<dd>{{.Item.Location}}</dd>
+{{- end}}
+{{- if .Item.Committee.Long}}
+<dt>Commissie</dt>
+<dd>{{.Item.Committee.Long}} ({{.Item.Committee.Short}})</dd>
+{{- end}}
+{{- if .Item.Link}}
+<dt>Notubiz</dt>
+<dd><a href="{{.Item.Link}}">{{.Item.Link}}</a></dd>
+{{- end}}
+</dl>
+{{- if .Item.ExtractedDocuments}}
+<h2>Documenten</h2>
+<ul>
+{{- range .Item.ExtractedDocuments}}
+<li><a href="{{.URL}}">{{.Title}}</a></li>
+{{- end}}
+</ul>
+{{- end}}
+<p><a href="{{.EventURL}}">Zet in je agenda</a> of abonneer je op de hele kalender: <a href="{{.Feed.URL}}">{{.Feed.URL}}</a></p>
+</body>
+</html>
+`
+
+var meetingPageTemplate = template.Must(template.New("meeting").Parse(meetingPageSrc))
+
+var (
+	dutchWeekdays = [...]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"}
+	dutchMonths   = [...]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"}
+)
+
+// findItem looks up a meeting of any tenant by its UID. The store has every meeting that was
+// ever seen, including those outside of the feed window.
+func findItem(ts []*tenant, uid string) (*tenant, CalItem, bool, error) {
+	for _, t := range ts {
+		i, ok, err := store.Get(t.Name, uid)
+		if err != nil {
+			return nil, CalItem{}, false, err
+		}
+		if ok && feedFilter.matches(i) {
+			return t, i, true, nil
+		}
+	}
+
+	return nil, CalItem{}, false, nil
+}
+
+// eventURL returns the URL of the calendar with only the given meeting.
+func eventURL(i CalItem) string {
+	return fmt.Sprintf("%s/event/%s.ics", feedURLPrefix, i.UID)
+}
+
+// eventCalendar returns a calendar with only the given meeting, to be imported rather than
+// subscribed to.
+func eventCalendar(t *tenant, i CalItem) icalComponent {
+	c := calendarComponent(feed{URL: eventURL(i), Name: t.CalName, Description: t.CalDesc}, []CalItem{i})
+	c.add(textProp("METHOD", "PUBLISH"))
+	return c
+}
+
+// formatWhen describes the time of a meeting in Dutch, eg. "donderdag 23 juni 2016, 20:00 - 23:00".
+func formatWhen(i CalItem) string {
+	if i.AllDay {
+		s := i.StartDateTime.In(time.UTC)
+		return fmt.Sprintf("%s %d %s %d", dutchWeekdays[s.Weekday()], s.Day(), dutchMonths[s.Month()-1], s.Year())
+	}
+
+	s, e := i.StartDateTime.In(cestTz), i.EndDateTime.In(cestTz)
+	return fmt.Sprintf("%s %d %s %d, %s - %s", dutchWeekdays[s.Weekday()], s.Day(), dutchMonths[s.Month()-1], s.Year(), s.Format("15:04"), e.Format("15:04"))
+}
+
+// lookupHandler finds the meeting with the UID in the path after prefix (without suffix) and
+// hands it to serve. Unknown meetings result in a 404.
+func lookupHandler(ts []*tenant, prefix, suffix string, serve func(http.ResponseWriter, *http.Request, *tenant, CalItem)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		uid := strings.TrimSuffix(name, suffix)
+		if uid == "" || (suffix != "" && uid == name) || strings.Contains(uid, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		t, i, ok, err := findItem(ts, uid)
+		if err != nil {
+			logger(r.Context()).Error("Unable to look up the meeting", "uid", uid, "err", err)
+			http.Error(w, "Couldn't read the meeting!", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		serve(w, r, t, i)
+	})
+}
+
+// eventHandler serves a calendar with a single meeting on {eventPrefix}{uid}.ics.
+func eventHandler(ts []*tenant) http.Handler {
+	return lookupHandler(ts, eventPrefix, ".ics", func(w http.ResponseWriter, r *http.Request, t *tenant, i CalItem) {
+		w.Header().Set("Content-Type", "text/calendar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ics"`, i.UID))
+		w.Header().Set("Cache-Control", "max-age=3600")
+
+		if err := eventCalendar(t, i).encode(w); err != nil {
+			logger(r.Context()).Error("Unable to render the meeting", "uid", i.UID, "err", err)
+		}
+	})
+}
+
+// meetingHandler serves a page with the details of a meeting on {meetingPrefix}{uid}.
+func meetingHandler(ts []*tenant) http.Handler {
+	return lookupHandler(ts, meetingPrefix, "", func(w http.ResponseWriter, r *http.Request, t *tenant, i CalItem) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "max-age=3600")
+
+		err := meetingPageTemplate.Execute(w, struct {
+			Item     CalItem
+			Feed     feed
+			When     string
+			EventURL string
+		}{i, t.feed(), formatWhen(i), eventPrefix + i.UID + ".ics"})
+
+		if err != nil {
+			logger(r.Context()).Error("Unable to render the meeting page", "uid", i.UID, "err", err)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeTestItems puts the test items, which are long out of the feed window, in a fresh store,
+// and returns loaded tenants.
+func storeTestItems() []*tenant {
+	store = newMemoryStore()
+
+	i3 := GetTestItem3()
+	i3.ExtractedDocuments = []document{{Title: "Agenda", URL: "https://leiden.notubiz.nl/document/1"}}
+	store.Replace(defaultTenant, []yearMonth{{2016, 6}}, []CalItem{GetTestItem1(), GetTestItem2(), i3}, GetTestTime())
+
+	ts, _ := parseTenants("oegstgeest,leiden")
+	for _, t := range ts {
+		t.markLoaded(time.Time{})
+	}
+	return ts
+}
+
+func lookupRequest(h http.Handler, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestEventShouldBeASingleEventCalendar(t *testing.T) {
+	h := eventHandler(storeTestItems())
+	i := GetTestItem2()
+
+	w := lookupRequest(h, eventPrefix+i.UID+".ics")
+
+	assert.Equal(t, http.StatusOK, w.Code, "Event not found!")
+	assert.Equal(t, "text/calendar", w.Header().Get("Content-Type"), "Wrong content type!")
+	assert.Contains(t, w.Body.String(), "METHOD:PUBLISH\r\n", "Calendar has no method!")
+	assert.Contains(t, w.Body.String(), "UID:"+i.UID+"@"+uidDomain, "Wrong event!")
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "BEGIN:VEVENT"), "Calendar doesn't have a single event!")
+}
+
+func TestEventShouldBeBuiltFromTheSameData(t *testing.T) {
+	storeTestItems()
+	i, _, _ := store.Get(defaultTenant, GetTestItem1().UID) // as the feed would have it
+
+	var expected strings.Builder
+	i.RenderItem(&expected)
+
+	w := lookupRequest(eventHandler([]*tenant{GetTestTenant()}), eventPrefix+i.UID+".ics")
+	assert.Contains(t, w.Body.String(), expected.String(), "Event differs from the feed!")
+}
+
+func TestMeetingPage(t *testing.T) {
+	h := meetingHandler(storeTestItems())
+	i := GetTestItem3()
+
+	w := lookupRequest(h, meetingPrefix+i.UID)
+
+	assert.Equal(t, http.StatusOK, w.Code, "Meeting not found!")
+	body := w.Body.String()
+	assert.Contains(t, body, "<h1>"+i.Description+"</h1>", "Description missing!")
+	assert.Contains(t, body, "donderdag 23 juni 2016, 20:00 - 23:00", "Time missing!")
+	assert.Contains(t, body, i.Location, "Location missing!")
+	assert.Contains(t, body, `<a href="`+i.Link+`">`, "Notubiz link missing!")
+	assert.Contains(t, body, `<li><a href="https://leiden.notubiz.nl/document/1">Agenda</a></li>`, "Documents missing!")
+	assert.Contains(t, body, `href="/kalender/event/`+i.UID+`.ics"`, "Event link missing!")
+}
+
+// Meetings that no longer exist upstream are kept in the store, and can still be looked up.
+func TestRemovedMeetingsShouldStillBeFound(t *testing.T) {
+	ts := storeTestItems()
+	store.Replace(defaultTenant, []yearMonth{{2016, 6}}, []CalItem{GetTestItem1(), GetTestItem3()}, GetTestTime())
+	i := GetTestItem2()
+
+	w := lookupRequest(meetingHandler(ts), meetingPrefix+i.UID)
+	assert.Equal(t, http.StatusOK, w.Code, "Removed meeting not found!")
+	assert.Contains(t, w.Body.String(), "<h1><del>"+i.Description+"</del> (verwijderd)</h1>", "Meeting not shown as removed!")
+
+	w = lookupRequest(eventHandler(ts), eventPrefix+i.UID+".ics")
+	assert.Equal(t, http.StatusOK, w.Code, "Removed event not found!")
+	assert.Contains(t, w.Body.String(), "\r\nSTATUS:CANCELLED\r\n", "Removed event not cancelled!")
+}
+
+func TestUnknownMeetingsShouldNotBeFound(t *testing.T) {
+	ts := storeTestItems()
+
+	for _, p := range []string{
+		eventPrefix + "leiden-1.ics",
+		eventPrefix + GetTestItem1().UID,
+		eventPrefix + ".ics",
+		eventPrefix + "a/" + GetTestItem1().UID + ".ics",
+	} {
+		assert.Equal(t, http.StatusNotFound, lookupRequest(eventHandler(ts), p).Code, "[%s] was found!", p)
+	}
+
+	for _, p := range []string{meetingPrefix + "leiden-1", meetingPrefix} {
+		assert.Equal(t, http.StatusNotFound, lookupRequest(meetingHandler(ts), p).Code, "[%s] was found!", p)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedFeeds is the number of feed variants (eg. filtered feeds) that are kept per tenant.
+const maxCachedFeeds = 64
+
+// Content codings, in order of preference.
+const (
+	encodingBrotli   = "br"
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+// renderedFeed is the body of a feed variant, rendered once and compressed in every content
+// coding that we support.
+type renderedFeed struct {
+	snapshot *snapshot // the data that it was rendered from
+	ready    chan struct{}
+	err      error
+
+	bodies   map[string][]byte // by content coding
+	etag     string            // of the identity coding, derived from the content
+	modified time.Time         // when the content last changed
+}
+
+// feedCache holds the rendered feed variants of a tenant. The unfiltered iCalendar feed is
+// rendered when a new snapshot is published, other variants when they are first requested.
+type feedCache struct {
+	mutex   sync.Mutex
+	entries map[string]*renderedFeed
+}
+
+// get returns the variant with the given key, rendered from snapshot s. Concurrent requests for
+// the same variant wait for a single rendering.
+func (c *feedCache) get(key string, s *snapshot, render func(io.Writer) error) *renderedFeed {
+	c.mutex.Lock()
+	prev, ok := c.entries[key]
+	if ok && prev.snapshot == s {
+		c.mutex.Unlock()
+		<-prev.ready
+		return prev
+	}
+
+	rf := &renderedFeed{snapshot: s, ready: make(chan struct{})}
+
+	// A request that started before a new snapshot was published doesn't replace its variant
+	cached := !ok || !prev.snapshot.published.After(s.published)
+	if !cached {
+		prev = nil
+	}
+
+	if c.entries == nil {
+		c.entries = make(map[string]*renderedFeed)
+	}
+	if cached && !ok && len(c.entries) >= maxCachedFeeds {
+		// Variants of older snapshots would have to be rendered again anyway
+		for k, e := range c.entries {
+			if e.snapshot != s {
+				delete(c.entries, k)
+			}
+		}
+		cached = len(c.entries) < maxCachedFeeds
+	}
+	if cached {
+		c.entries[key] = rf
+	}
+	c.mutex.Unlock()
+
+	if prev != nil {
+		<-prev.ready
+	}
+	rf.render(render, prev)
+
+	if rf.err != nil && cached {
+		c.mutex.Lock()
+		if c.entries[key] == rf {
+			delete(c.entries, key)
+		}
+		c.mutex.Unlock()
+	}
+
+	return rf
+}
+
+// render fills in the feed. If it is the same as the rendering of the previous snapshot, the
+// modification time and compressed bodies of that one are kept.
+func (rf *renderedFeed) render(render func(io.Writer) error, prev *renderedFeed) {
+	defer close(rf.ready)
+
+	var b bytes.Buffer
+	if rf.err = render(&b); rf.err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(b.Bytes())
+	rf.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	if prev != nil && prev.err == nil && prev.etag == rf.etag {
+		rf.modified = prev.modified
+		rf.bodies = prev.bodies
+		return
+	}
+
+	rf.modified = rf.snapshot.published
+	rf.bodies = compressAll(b.Bytes())
+}
+
+// compressAll returns the body in every content coding that we support.
+func compressAll(body []byte) map[string][]byte {
+	bodies := map[string][]byte{encodingIdentity: body}
+
+	var gz bytes.Buffer
+	gw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	gw.Write(body)
+	gw.Close()
+	bodies[encodingGzip] = gz.Bytes()
+
+	var br bytes.Buffer
+	bw := brotli.NewWriterLevel(&br, brotli.DefaultCompression)
+	bw.Write(body)
+	bw.Close()
+	bodies[encodingBrotli] = br.Bytes()
+
+	return bodies
+}
+
+// negotiateEncoding returns the content coding to use for the given Accept-Encoding header.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q > 0
+	}
+
+	for _, coding := range []string{encodingBrotli, encodingGzip} {
+		if ok, listed := accepted[coding]; ok || (!listed && accepted["*"]) {
+			return coding
+		}
+	}
+	return encodingIdentity
+}
+
+// serve writes the feed in the best content coding for the request, or answers conditional
+// requests with 304 Not Modified.
+func (rf *renderedFeed) serve(w http.ResponseWriter, r *http.Request, contentType string) {
+	if rf.err != nil {
+		logger(r.Context()).Error("Unable to render the feed", "path", r.URL.Path, "err", rf.err)
+		http.Error(w, "Couldn't render calendar items!", http.StatusInternalServerError)
+		return
+	}
+
+	coding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+
+	// Every coding is a different representation, so it needs its own strong ETag
+	etag := rf.etag
+	if coding != encodingIdentity {
+		etag = strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+		w.Header().Set("Content-Encoding", coding)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "max-age=3600")
+	vary := "Accept-Encoding"
+	if v := w.Header().Get("Vary"); v != "" {
+		vary = v + ", " + vary // eg. Accept for negotiated feeds
+	}
+	w.Header().Set("Vary", vary)
+	w.Header().Set("ETag", etag)
+
+	http.ServeContent(w, r, "", rf.modified, bytes.NewReader(rf.bodies[coding]))
+}
+
+// serveFeed serves a feed variant of snapshot s of the tenant, rendering it if it isn't cached yet.
+func (t *tenant) serveFeed(w http.ResponseWriter, r *http.Request, s *snapshot, key, contentType string, render func(io.Writer) error) {
+	t.feeds.get(key, s, render).serve(w, r, contentType)
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func feedRequest(h http.Handler, header ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/kalender/alles.ics", nil)
+	for n := 0; n+1 < len(header); n += 2 {
+		req.Header.Set(header[n], header[n+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	testSet := []struct {
+		header   string
+		expected string
+	}{
+		{"", encodingIdentity},
+		{"gzip, deflate", encodingGzip},
+		{"gzip, deflate, br", encodingBrotli},
+		{"br;q=0, gzip;q=0.5", encodingGzip},
+		{"GZIP", encodingGzip},
+		{"*", encodingBrotli},
+		{"*, br;q=0", encodingGzip},
+		{"identity", encodingIdentity},
+	}
+
+	for _, i := range testSet {
+		assert.Equal(t, i.expected, negotiateEncoding(i.header), "Wrong coding for [%s]!", i.header)
+	}
+}
+
+func TestFeedShouldBeCompressed(t *testing.T) {
+	tt := GetTestTenant()
+	tt.setCalItems([]CalItem{GetTestItem1(), GetTestItem2()})
+	h := calHandler(tt)
+
+	plain := feedRequest(h)
+	assert.Equal(t, "", plain.Header().Get("Content-Encoding"), "Uncompressed feed was encoded!")
+	assert.Equal(t, "Accept, Accept-Encoding", plain.Header().Get("Vary"), "Vary missing!")
+
+	gz := feedRequest(h, "Accept-Encoding", "gzip")
+	assert.Equal(t, "gzip", gz.Header().Get("Content-Encoding"), "Feed not gzipped!")
+	gr, err := gzip.NewReader(gz.Body)
+	if assert.Nil(t, err, "Invalid gzip!") {
+		b, _ := ioutil.ReadAll(gr)
+		assert.Equal(t, plain.Body.String(), string(b), "Gzipped feed differs!")
+	}
+
+	br := feedRequest(h, "Accept-Encoding", "gzip, br")
+	assert.Equal(t, "br", br.Header().Get("Content-Encoding"), "Feed not compressed with brotli!")
+	b, _ := ioutil.ReadAll(brotli.NewReader(br.Body))
+	assert.Equal(t, plain.Body.String(), string(b), "Brotli feed differs!")
+
+	assert.NotEqual(t, plain.Header().Get("ETag"), gz.Header().Get("ETag"), "Codings share an ETag!")
+	assert.NotEqual(t, gz.Header().Get("ETag"), br.Header().Get("ETag"), "Codings share an ETag!")
+}
+
+func TestFeedShouldAnswerConditionalRequests(t *testing.T) {
+	tt := GetTestTenant()
+	tt.setCalItems([]CalItem{GetTestItem1()})
+	h := calHandler(tt)
+
+	first := feedRequest(h, "Accept-Encoding", "gzip")
+	etag := first.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}-gzip"$`, etag, "No strong ETag!")
+	assert.NotEmpty(t, first.Header().Get("Last-Modified"), "No Last-Modified!")
+
+	cached := feedRequest(h, "Accept-Encoding", "gzip", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, cached.Code, "Unchanged feed was sent again!")
+	assert.Empty(t, cached.Body.String(), "304 has a body!")
+
+	since := feedRequest(h, "If-Modified-Since", first.Header().Get("Last-Modified"))
+	assert.Equal(t, http.StatusNotModified, since.Code, "Unchanged feed was sent again!")
+
+	// New data results in a new ETag
+	tt.setCalItems([]CalItem{GetTestItem1(), GetTestItem2()})
+	changed := feedRequest(h, "Accept-Encoding", "gzip", "If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, changed.Code, "Changed feed was not sent!")
+	assert.NotEqual(t, etag, changed.Header().Get("ETag"), "Changed feed kept its ETag!")
+}
+
+func TestLastModifiedShouldOnlyChangeWithTheContent(t *testing.T) {
+	tt := GetTestTenant()
+	tt.current.Store(&snapshot{items: []CalItem{GetTestItem1()}, published: time.Now().Add(-time.Hour)})
+	h := calHandler(tt)
+
+	first := feedRequest(h)
+
+	tt.setCalItems([]CalItem{GetTestItem1()})
+	same := feedRequest(h)
+	assert.Equal(t, first.Header().Get("Last-Modified"), same.Header().Get("Last-Modified"), "Unchanged feed got a new Last-Modified!")
+	assert.Equal(t, first.Header().Get("ETag"), same.Header().Get("ETag"), "Unchanged feed got a new ETag!")
+
+	tt.setCalItems([]CalItem{GetTestItem2()})
+	changed := feedRequest(h)
+	assert.NotEqual(t, first.Header().Get("Last-Modified"), changed.Header().Get("Last-Modified"), "Changed feed kept its Last-Modified!")
+}
+
+func TestFeedCacheShouldRenderOncePerSnapshot(t *testing.T) {
+	var c feedCache
+	var renders int32
+	render := func(w io.Writer) error {
+		atomic.AddInt32(&renders, 1)
+		time.Sleep(10 * time.Millisecond)
+		_, err := io.WriteString(w, "feed")
+		return err
+	}
+
+	s1 := &snapshot{published: time.Now()}
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.get("alles.ics?", s1, render)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&renders), "Feed was rendered more than once!")
+
+	s2 := &snapshot{published: s1.published.Add(time.Second)}
+	c.get("alles.ics?", s2, render)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&renders), "New snapshot was not rendered!")
+
+	// A request that still has the old snapshot doesn't replace the new rendering
+	c.get("alles.ics?", s1, render)
+	assert.Equal(t, s2, c.get("alles.ics?", s2, render).snapshot, "Old snapshot replaced the new one!")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&renders), "Wrong amount of renders!")
+}
+
+func TestFeedCacheShouldBeBounded(t *testing.T) {
+	var c feedCache
+	s := &snapshot{published: time.Now()}
+	render := func(w io.Writer) error { return nil }
+
+	for n := 0; n < maxCachedFeeds+10; n++ {
+		c.get(string(rune('a'+n)), s, render)
+	}
+	assert.Equal(t, maxCachedFeeds, len(c.entries), "Cache is not bounded!")
+
+	c.get("new", &snapshot{published: s.published.Add(time.Second)}, render)
+	assert.Equal(t, 1, len(c.entries), "Old variants were not evicted!")
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const filterDateLayout = "2006-01-02"
+
+// itemFilter selects calendar items based on the query string of a feed request, eg.
+// ?include=gemeenteraad,raadscommissie&exclude=college&location=raadzaal&q=begroting&from=2026-01-01&to=2026-06-30
+type itemFilter struct {
+	include  []string
+	exclude  []string
+	location string
+	query    string
+	from     time.Time
+	to       time.Time // exclusive
+}
+
+// feedFilter is applied to every feed, before the filter of the request.
+var feedFilter itemFilter
+
+var filterParams = map[string]func(*itemFilter, string) error{
+	"include": func(f *itemFilter, v string) error {
+		f.include = splitFilterList(v)
+		return nil
+	},
+	"exclude": func(f *itemFilter, v string) error {
+		f.exclude = splitFilterList(v)
+		return nil
+	},
+	"location": func(f *itemFilter, v string) error {
+		f.location = strings.ToLower(strings.TrimSpace(v))
+		return nil
+	},
+	"q": func(f *itemFilter, v string) error {
+		f.query = strings.ToLower(strings.TrimSpace(v))
+		return nil
+	},
+	"from": func(f *itemFilter, v string) error {
+		d, err := parseFilterDate("from", v)
+		f.from = d
+		return err
+	},
+	"to": func(f *itemFilter, v string) error {
+		d, err := parseFilterDate("to", v)
+		if err == nil {
+			d = d.AddDate(0, 0, 1) // include the whole day
+		}
+		f.to = d
+		return err
+	},
+}
+
+// parseItemFilter creates a filter from the query parameters. Unknown or malformed parameters
+// result in an error that can be shown to the user.
+func parseItemFilter(v url.Values) (itemFilter, error) {
+	var f itemFilter
+
+	// Go through the parameters in a fixed order so the errors are predictable
+	names := make([]string, 0, len(v))
+	for n := range v {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		set, ok := filterParams[n]
+		if !ok {
+			return itemFilter{}, fmt.Errorf("Unknown parameter [%s]! Supported parameters are: exclude, from, include, location, q, to.", n)
+		}
+		if len(v[n]) > 1 {
+			return itemFilter{}, fmt.Errorf("Parameter [%s] may only be specified once!", n)
+		}
+		if err := set(&f, v.Get(n)); err != nil {
+			return itemFilter{}, err
+		}
+	}
+
+	if !f.from.IsZero() && !f.to.IsZero() && !f.from.Before(f.to) {
+		return itemFilter{}, errors.New("Parameter [from] must not be after parameter [to]!")
+	}
+
+	return f, nil
+}
+
+func splitFilterList(v string) []string {
+	var l []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+func parseFilterDate(name string, v string) (time.Time, error) {
+	d, err := time.ParseInLocation(filterDateLayout, strings.TrimSpace(v), cestTz)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Parameter [%s] must be a date formatted as YYYY-MM-DD, not [%s]!", name, v)
+	}
+	return d, nil
+}
+
+// apply returns the items that match the filter.
+func (f itemFilter) apply(items []CalItem) []CalItem {
+	var fis []CalItem
+
+	for _, i := range items {
+		if f.matches(i) {
+			fis = append(fis, i)
+		}
+	}
+
+	return fis
+}
+
+func (f itemFilter) matches(i CalItem) bool {
+	if len(f.include) > 0 && !matchesKind(i, f.include) {
+		return false
+	}
+	if matchesKind(i, f.exclude) {
+		return false
+	}
+	if f.location != "" && !strings.Contains(strings.ToLower(i.Location), f.location) {
+		return false
+	}
+	if f.query != "" && !matchesQuery(i, f.query) {
+		return false
+	}
+	if !f.from.IsZero() && i.StartDateTime.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && !i.StartDateTime.Before(f.to) {
+		return false
+	}
+
+	return true
+}
+
+// matchesKind checks whether the kind of the item, or its committee, is in the list.
+func matchesKind(i CalItem, kinds []string) bool {
+	for _, k := range kinds {
+		if k == itemKind(i) || (i.Committee.ID != 0 && k == strings.ToLower(i.Committee.Short)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesQuery(i CalItem, q string) bool {
+	if strings.Contains(strings.ToLower(i.Description), q) || strings.Contains(strings.ToLower(i.Location), q) {
+		return true
+	}
+
+	for _, d := range i.ExtractedDocuments {
+		if strings.Contains(strings.ToLower(d.Title), q) {
+			return true
+		}
+	}
+
+	return false
+}
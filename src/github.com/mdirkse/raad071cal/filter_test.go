@@ -0,0 +1,100 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFilterShouldSelectCorrectItems(t *testing.T) {
+	items := []CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()}
+
+	testSet := []struct {
+		query    string
+		expected []CalItem
+	}{
+		{"", items},
+		{"include=raadscommissie", []CalItem{GetTestItem3()}},
+		{"include=einde,instructiebijeenkomst", []CalItem{GetTestItem1(), GetTestItem2()}},
+		{"include=os", []CalItem{GetTestItem2()}},
+		{"exclude=RAADSCOMMISSIE", []CalItem{GetTestItem1(), GetTestItem2()}},
+		{"location=raadzaal", []CalItem{GetTestItem2()}},
+		{"location=stadhuis", []CalItem{GetTestItem2(), GetTestItem3()}},
+		{"q=zomer", []CalItem{GetTestItem1()}},
+		{"q=ical+spec", []CalItem{GetTestItem2()}},
+		{"from=2016-06-23&to=2016-06-23", items},
+		{"from=2016-06-24", nil},
+		{"to=2016-06-22", nil},
+		{"include=raadscommissie&q=zomer", nil},
+	}
+
+	for _, ts := range testSet {
+		v, _ := url.ParseQuery(ts.query)
+		f, err := parseItemFilter(v)
+
+		assert.Nil(t, err, "Unable to parse filter [%s]!", ts.query)
+		assert.Equal(t, ts.expected, f.apply(items), "Filter [%s] selected the wrong items!", ts.query)
+	}
+}
+
+func TestInvalidFiltersShouldYieldAnError(t *testing.T) {
+	testSet := []struct {
+		query    string
+		expected string
+	}{
+		{"bla=1", "Unknown parameter [bla]!"},
+		{"from=01-01-2016", "Parameter [from] must be a date"},
+		{"to=gisteren", "Parameter [to] must be a date"},
+		{"from=2016-07-01&to=2016-06-01", "Parameter [from] must not be after parameter [to]!"},
+		{"q=a&q=b", "Parameter [q] may only be specified once!"},
+	}
+
+	for _, ts := range testSet {
+		v, _ := url.ParseQuery(ts.query)
+		_, err := parseItemFilter(v)
+
+		if assert.NotNil(t, err, "Invalid filter [%s] was accepted!", ts.query) {
+			assert.Contains(t, err.Error(), ts.expected, "Wrong error for filter [%s]!", ts.query)
+		}
+	}
+}
+
+func TestHttpEndpointShouldApplyFilters(t *testing.T) {
+	tt := GetTestTenant()
+	tt.setCalItems([]CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()})
+
+	req, _ := http.NewRequest("GET", "http://bla.com/kalender/alles.ics?include=raadscommissie", nil)
+	w := httptest.NewRecorder()
+	calHandler(tt).ServeHTTP(w, req)
+
+	var expected bytes.Buffer
+	renderCalendar(tt.feed(), []CalItem{GetTestItem3()}, &expected)
+
+	assert.Equal(t, 200, w.Code, "Request returned incorrect status!")
+	assert.Equal(t, expected.String(), w.Body.String(), "Filtered request went awry!")
+}
+
+func TestHttpEndpointShouldRejectUnknownParameters(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://bla.com/kalender/alles.ics?incude=raadscommissie", nil)
+	w := httptest.NewRecorder()
+	calHandler(GetTestTenant()).ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code, "Request returned incorrect status!")
+	assert.Contains(t, w.Body.String(), "Unknown parameter [incude]!", "Wrong error message!")
+}
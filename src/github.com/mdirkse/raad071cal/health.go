@@ -0,0 +1,116 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// notLoadedRetryAfter is how long clients are asked to wait for a feed that hasn't been loaded yet.
+const notLoadedRetryAfter = 30 * time.Second
+
+// maxDataAge is how old the last successful poll of a tenant may be for the service to be ready.
+var maxDataAge = 24 * time.Hour
+
+// markLoaded records that the feed of the tenant has data: after a poll in which every month was
+// fetched (at is the time of the poll), or from the store or a partial poll (at is zero).
+func (t *tenant) markLoaded(at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.loaded = true
+	if !at.IsZero() {
+		t.lastSuccess = at
+	}
+}
+
+func (t *tenant) isLoaded() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.loaded
+}
+
+// lastSuccessfulPoll returns when the tenant was last polled successfully, or zero if it never was.
+func (t *tenant) lastSuccessfulPoll() time.Time {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.lastSuccess
+}
+
+// readiness returns why the tenant isn't ready, or an empty string if it is.
+func (t *tenant) readiness(now time.Time) string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	switch {
+	case t.lastSuccess.IsZero():
+		return "not polled successfully yet"
+	case now.Sub(t.lastSuccess) > maxDataAge:
+		return fmt.Sprintf("last successful poll at %s is older than %s", t.lastSuccess.Format(time.RFC3339), maxDataAge)
+	default:
+		return ""
+	}
+}
+
+// loadedHandler answers with 503 Service Unavailable until the tenant has data, so clients don't
+// sync an empty calendar and delete all their events.
+func loadedHandler(t *tenant, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !t.isLoaded() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(notLoadedRetryAfter.Seconds())))
+			http.Error(w, "The calendar hasn't been loaded yet, please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// readyzHandler reports whether every tenant has been polled successfully recently enough.
+func readyzHandler(ts []*tenant) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		notReady := make(map[string]string)
+		for _, t := range ts {
+			if reason := t.readiness(now); reason != "" {
+				notReady[t.Name] = reason
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		status := http.StatusOK
+		if len(notReady) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"ready": len(notReady) == 0, "notReady": notReady}); err != nil {
+			logger(r.Context()).Error("Unable to write the readiness", "err", err)
+		}
+	})
+}
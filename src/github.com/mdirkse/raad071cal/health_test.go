@@ -0,0 +1,114 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFeedsShouldBeUnavailableUntilLoaded(t *testing.T) {
+	tt := GetTestTenant()
+	h := loadedHandler(tt, calHandler(tt))
+
+	req, _ := http.NewRequest("GET", "/kalender/alles.ics", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "Feed without data was served!")
+	assert.Equal(t, "30", w.Header().Get("Retry-After"), "Retry-After missing!")
+
+	tt.markLoaded(time.Time{})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "Loaded feed was not served!")
+}
+
+func TestHealthz(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+	healthzHandler().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "Process is not healthy!")
+}
+
+func TestReadyzShouldRequireRecentData(t *testing.T) {
+	ts, _ := parseTenants("leiden,oegstgeest")
+	h := readyzHandler(ts)
+	ready := func() int {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "Ready without data!")
+
+	// Data from the store doesn't count as a successful poll
+	ts[0].markLoaded(time.Time{})
+	ts[1].markLoaded(time.Now())
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "Ready without a successful poll!")
+	assert.Equal(t, "not polled successfully yet", ts[0].readiness(time.Now()), "Wrong reason!")
+
+	ts[0].markLoaded(time.Now().Add(-maxDataAge - time.Minute))
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "Ready with stale data!")
+
+	ts[0].markLoaded(time.Now())
+	assert.Equal(t, http.StatusOK, ready(), "Not ready with recent data!")
+}
+
+func TestPollShouldMarkTheTenantLoaded(t *testing.T) {
+	store = newMemoryStore()
+
+	failing := true
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if failing {
+			http.Error(w, "Eep!", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`callback_function({"success": true, "meetings": []})`))
+	})
+	defer srv.Close()
+
+	loadCalendarItems(context.Background(), tt)
+	assert.False(t, tt.isLoaded(), "Failed poll marked the tenant loaded!")
+
+	failing = false
+	loadCalendarItems(context.Background(), tt)
+	assert.True(t, tt.isLoaded(), "Successful poll didn't mark the tenant loaded!")
+	assert.Equal(t, "", tt.readiness(time.Now()), "Tenant not ready after a successful poll!")
+}
+
+func TestPartialPollShouldNotCountAsSuccessful(t *testing.T) {
+	store = newMemoryStore()
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if ym.month == 8 {
+			http.Error(w, "Eep!", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`callback_function({"success": true, "meetings": []})`))
+	})
+	defer srv.Close()
+
+	loadCalendarItems(context.Background(), tt)
+	assert.True(t, tt.isLoaded(), "Partial poll didn't mark the tenant loaded!")
+	assert.True(t, tt.lastSuccessfulPoll().IsZero(), "Partial poll counted as successful!")
+	assert.Equal(t, "not polled successfully yet", tt.readiness(time.Now()), "Tenant ready after a partial poll!")
+}
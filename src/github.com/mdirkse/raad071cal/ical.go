@@ -0,0 +1,193 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// This file contains a small iCalendar (RFC 5545) writer. Calendars are built as a tree of
+// components and properties, which are serialised with proper escaping, line folding and CRLF
+// line endings.
+
+const (
+	icalLineEnd      = "\r\n"
+	icalMaxLineOctet = 75
+	icalDateLayout   = "20060102"
+	icalLocalLayout  = "20060102T150405"
+	icalUTCLayout    = "20060102T150405Z"
+)
+
+// icalValueType is the value type of a property (RFC 5545 section 3.3).
+type icalValueType string
+
+const (
+	icalText     icalValueType = "TEXT"
+	icalDate     icalValueType = "DATE"
+	icalDateTime icalValueType = "DATE-TIME"
+	icalURI      icalValueType = "URI"
+	icalInteger  icalValueType = "INTEGER"
+	icalDuration icalValueType = "DURATION"
+	icalOffset   icalValueType = "UTC-OFFSET"
+)
+
+type icalParam struct {
+	Name   string
+	Values []string
+}
+
+// icalProperty is a single content line. The value is kept unescaped, escaping happens
+// when the property is written.
+type icalProperty struct {
+	Name   string
+	Params []icalParam
+	Type   icalValueType
+	Value  string
+}
+
+type icalComponent struct {
+	Name       string
+	Properties []icalProperty
+	Components []icalComponent
+}
+
+func textProp(name string, value string, params ...icalParam) icalProperty {
+	return icalProperty{Name: name, Params: params, Type: icalText, Value: value}
+}
+
+func uriProp(name string, value string) icalProperty {
+	return icalProperty{Name: name, Type: icalURI, Value: value}
+}
+
+func utcProp(name string, t time.Time) icalProperty {
+	return icalProperty{Name: name, Type: icalDateTime, Value: t.In(time.UTC).Format(icalUTCLayout)}
+}
+
+func dateProp(name string, t time.Time) icalProperty {
+	return icalProperty{
+		Name:   name,
+		Params: []icalParam{{"VALUE", []string{string(icalDate)}}},
+		Type:   icalDate,
+		Value:  t.Format(icalDateLayout),
+	}
+}
+
+// add appends the property, unless its value is empty.
+func (c *icalComponent) add(p icalProperty) {
+	if p.Value != "" {
+		c.Properties = append(c.Properties, p)
+	}
+}
+
+// encode writes the component, including all its sub components, to w.
+func (c icalComponent) encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	c.write(bw)
+	return bw.Flush()
+}
+
+func (c icalComponent) write(w *bufio.Writer) {
+	writeContentLine(w, "BEGIN:"+c.Name)
+	for _, p := range c.Properties {
+		writeContentLine(w, p.String())
+	}
+	for _, sc := range c.Components {
+		sc.write(w)
+	}
+	writeContentLine(w, "END:"+c.Name)
+}
+
+// String returns the unfolded content line of the property.
+func (p icalProperty) String() string {
+	var b strings.Builder
+	b.WriteString(p.Name)
+
+	for _, prm := range p.Params {
+		b.WriteByte(';')
+		b.WriteString(prm.Name)
+		b.WriteByte('=')
+		for i, v := range prm.Values {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(quoteParamValue(v))
+		}
+	}
+
+	b.WriteByte(':')
+	if p.Type == icalText {
+		b.WriteString(escapeText(p.Value))
+	} else {
+		b.WriteString(p.Value)
+	}
+
+	return b.String()
+}
+
+// escapeText escapes a TEXT value (RFC 5545 section 3.3.11).
+func escapeText(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', ';', ',':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			// Dropped, a CRLF in the input becomes a single \n
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// quoteParamValue quotes parameter values that contain characters with a special meaning.
+// Double quotes can't be represented in a parameter value at all so they are removed.
+func quoteParamValue(v string) string {
+	v = strings.Replace(v, `"`, "", -1)
+	if strings.ContainsAny(v, ":;,") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// writeContentLine writes a line folded at 75 octets, never splitting a UTF-8 sequence.
+func writeContentLine(w *bufio.Writer, line string) {
+	limit := icalMaxLineOctet
+
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+
+		w.WriteString(line[:cut])
+		w.WriteString(icalLineEnd)
+		w.WriteByte(' ')
+
+		line = line[cut:]
+		limit = icalMaxLineOctet - 1 // the leading space counts as well
+	}
+
+	w.WriteString(line)
+	w.WriteString(icalLineEnd)
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// testTricky is a value that needs escaping and, combined with a few copies, folding.
+const testTricky = "Begroting 2017; amendementen, moties \\ overig\nTweede regel: één café 🏛️"
+
+func TestEscapeTextShouldEscapeSpecialCharacters(t *testing.T) {
+	testSet := []struct {
+		input    string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"a,b;c\\d", `a\,b\;c\\d`},
+		{"line1\nline2", `line1\nline2`},
+		{"line1\r\nline2", `line1\nline2`},
+		{"colon: fine", "colon: fine"},
+	}
+
+	for _, ts := range testSet {
+		assert.Equal(t, ts.expected, escapeText(ts.input), "Text [%q] incorrectly escaped!", ts.input)
+	}
+}
+
+func TestParamValuesShouldBeQuotedWhenNeeded(t *testing.T) {
+	p := textProp("LOCATION", "x", icalParam{"ALTREP", []string{"http://example.com/a;b"}}, icalParam{"LANGUAGE", []string{"nl"}})
+
+	assert.Equal(t, `LOCATION;ALTREP="http://example.com/a;b";LANGUAGE=nl:x`, p.String(), "Parameters incorrectly rendered!")
+}
+
+func TestEmptyPropertiesShouldBeOmitted(t *testing.T) {
+	c := icalComponent{Name: "VEVENT"}
+	c.add(textProp("LOCATION", ""))
+
+	assert.Empty(t, c.Properties, "Empty property was added!")
+}
+
+func TestLinesShouldBeFoldedOnUTF8Boundaries(t *testing.T) {
+	for n := 1; n < 120; n++ {
+		value := strings.Repeat("é", n) + strings.Repeat(testTricky, n%4)
+
+		var b bytes.Buffer
+		c := icalComponent{Name: "VEVENT"}
+		c.add(textProp("SUMMARY", value))
+		c.encode(&b)
+
+		assertCompliant(t, b.String())
+
+		parsed, err := parseICal(b.String())
+		if assert.Nil(t, err, "Unable to parse folded output!") {
+			assert.Equal(t, value, parsed.value("SUMMARY"), "Value changed by folding!")
+		}
+	}
+}
+
+func TestRenderedCalendarShouldRoundTrip(t *testing.T) {
+	tricky := GetTestItem2()
+	tricky.Description = testTricky + strings.Repeat(" lang", 30)
+	tricky.Location = "Raadzaal; 1e verdieping, Stadhuis, Leiden"
+	tricky.ExtractedDocuments = []document{{Title: "Brief, van B&W; over \\ dingen", URL: "https://example.com/a,b;c"}}
+
+	items := []CalItem{GetTestItem1(), tricky, GetTestItem3()}
+	f := GetTestTenant().feed()
+
+	var b bytes.Buffer
+	err := renderCalendar(f, items, &b)
+	assert.Nil(t, err, "Unable to render calendar!")
+
+	assertCompliant(t, b.String())
+
+	cal, err := parseICal(b.String())
+	if !assert.Nil(t, err, "Unable to parse rendered calendar!") {
+		return
+	}
+
+	assert.Equal(t, "VCALENDAR", cal.name, "Wrong root component!")
+	assert.Equal(t, f.Name, cal.value("X-WR-CALNAME"), "Calendar name changed!")
+	assert.Equal(t, len(items)+1, len(cal.children), "Wrong amount of components!")
+	assert.Equal(t, "VTIMEZONE", cal.children[0].name, "Timezone not rendered first!")
+
+	for n, i := range items {
+		e := cal.children[n+1]
+		assert.Equal(t, "VEVENT", e.name, "Wrong event component!")
+		assert.Equal(t, i.UID+"@"+uidDomain, e.value("UID"), "UID changed!")
+		assert.Equal(t, i.Description, e.value("SUMMARY"), "SUMMARY changed!")
+		assert.Equal(t, i.Location, e.value("LOCATION"), "LOCATION changed!")
+		assert.Equal(t, renderDescription(i), e.value("DESCRIPTION"), "DESCRIPTION changed!")
+	}
+}
+
+// assertCompliant checks the physical layout of an iCalendar stream.
+func assertCompliant(t *testing.T, s string) {
+	assert.True(t, strings.HasSuffix(s, "\r\n"), "Output does not end with CRLF!")
+
+	for _, l := range strings.Split(strings.TrimSuffix(s, "\r\n"), "\r\n") {
+		assert.False(t, strings.ContainsAny(l, "\r\n"), "Line [%q] contains a bare CR or LF!", l)
+		assert.True(t, len(l) <= icalMaxLineOctet, "Line [%q] is longer than 75 octets!", l)
+		assert.True(t, utf8.ValidString(l), "Line [%q] splits a UTF-8 sequence!", l)
+	}
+}
+
+// testComponent is the result of parsing iCalendar data in the tests.
+type testComponent struct {
+	name     string
+	props    map[string][]string
+	children []*testComponent
+}
+
+func (c *testComponent) value(name string) string {
+	if vs := c.props[name]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// parseICal is a minimal, strict iCalendar parser that is independent of the writer.
+func parseICal(s string) (*testComponent, error) {
+	if strings.Contains(strings.Replace(s, "\r\n", "", -1), "\n") {
+		return nil, fmt.Errorf("bare LF found")
+	}
+
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSuffix(s, "\r\n"), "\r\n") {
+		if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
+			if len(lines) == 0 {
+				return nil, fmt.Errorf("continuation without a line")
+			}
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+
+	var stack []*testComponent
+	var root *testComponent
+
+	for _, l := range lines {
+		name, value, err := splitContentLine(l)
+		if err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "BEGIN":
+			c := &testComponent{name: value, props: map[string][]string{}}
+			if len(stack) > 0 {
+				p := stack[len(stack)-1]
+				p.children = append(p.children, c)
+			} else if root != nil {
+				return nil, fmt.Errorf("more than one root component")
+			} else {
+				root = c
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].name != value {
+				return nil, fmt.Errorf("unbalanced END:%s", value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("property %s outside of a component", name)
+			}
+			c := stack[len(stack)-1]
+			uv, err := unescapeText(value)
+			if err != nil {
+				return nil, err
+			}
+			c.props[name] = append(c.props[name], uv)
+		}
+	}
+
+	if len(stack) != 0 || root == nil {
+		return nil, fmt.Errorf("incomplete calendar")
+	}
+
+	return root, nil
+}
+
+// splitContentLine returns the name and the raw value of a content line, skipping the parameters.
+func splitContentLine(l string) (string, string, error) {
+	inQuotes := false
+	nameEnd := -1
+
+	for i, r := range l {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ';' && !inQuotes && nameEnd < 0:
+			nameEnd = i
+		case r == ':' && !inQuotes:
+			if nameEnd < 0 {
+				nameEnd = i
+			}
+			return l[:nameEnd], l[i+1:], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no value in line [%s]", l)
+}
+
+func unescapeText(v string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == ',' || c == ';' {
+			return "", fmt.Errorf("unescaped [%c] in [%s]", c, v)
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i == len(v) {
+			return "", fmt.Errorf("dangling escape in [%s]", v)
+		}
+		switch v[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		case '\\', ';', ',':
+			b.WriteByte(v[i])
+		default:
+			return "", fmt.Errorf("invalid escape in [%s]", v)
+		}
+	}
+
+	return b.String(), nil
+}
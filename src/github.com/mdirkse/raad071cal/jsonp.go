@@ -0,0 +1,128 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+)
+
+// Errors for responses that Notubiz should not have given. Use errors.Is to check for them.
+var (
+	ErrNotJSONP        = errors.New("Response is not JSON(P)")
+	ErrUpstreamFailure = errors.New("Notubiz reported a failure")
+	ErrSchemaChanged   = errors.New("Response doesn't match the expected schema")
+)
+
+// jsonpCallback matches the start of a JSONP response, eg. `callback_function(`.
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][\w$.]*\s*\(`)
+
+// envelope is what Notubiz wraps around every response.
+type envelope struct {
+	Success *bool           `json:"success"`
+	Request string          `json:"request"`
+	Message string          `json:"message"`
+	Error   json.RawMessage `json:"error"`
+}
+
+// decodeJSONP returns the JSON in a JSONP response, whatever the name of the callback. Plain
+// JSON responses are returned as they are.
+func decodeJSONP(body []byte) ([]byte, error) {
+	payload := bytes.TrimSpace(body)
+	payload = bytes.TrimSpace(bytes.TrimRight(payload, ";"))
+
+	if loc := jsonpCallback.FindIndex(payload); loc != nil {
+		if !bytes.HasSuffix(payload, []byte(")")) {
+			return nil, fmt.Errorf("%w: unterminated callback [%s]", ErrNotJSONP, snippet(payload))
+		}
+		payload = bytes.TrimSpace(payload[loc[1] : len(payload)-1])
+	}
+
+	if len(payload) == 0 || (payload[0] != '{' && payload[0] != '[') {
+		return nil, fmt.Errorf("%w: [%s]", ErrNotJSONP, snippet(payload))
+	}
+	if !json.Valid(payload) {
+		return nil, fmt.Errorf("%w: invalid JSON [%s]", ErrNotJSONP, snippet(payload))
+	}
+
+	return payload, nil
+}
+
+// decodeCalendarMonth checks the envelope of a calendar response and decodes the month in it.
+func decodeCalendarMonth(payload []byte) (calendarMonth, error) {
+	var cm calendarMonth
+
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return cm, fmt.Errorf("%w: %+v", ErrSchemaChanged, err)
+	}
+	if env.Success == nil {
+		return cm, fmt.Errorf("%w: no success field", ErrSchemaChanged)
+	}
+	if !*env.Success {
+		return cm, fmt.Errorf("%w: request [%s] was not successful [%s%s]", ErrUpstreamFailure, env.Request, env.Message, env.Error)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return cm, fmt.Errorf("%w: %+v", ErrSchemaChanged, err)
+	}
+	if _, ok := fields["meetings"]; !ok {
+		return cm, fmt.Errorf("%w: no meetings field", ErrSchemaChanged)
+	}
+
+	if err := json.Unmarshal(payload, &cm); err != nil {
+		return cm, fmt.Errorf("%w: %+v", ErrSchemaChanged, err)
+	}
+
+	return cm, nil
+}
+
+// errorReason classifies the error of a failed month for the poll status.
+func errorReason(err error) string {
+	var se upstreamStatusError
+	var ne net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled" // eg. on shutdown
+	case errors.Is(err, ErrNotJSONP):
+		return "not-jsonp"
+	case errors.Is(err, ErrUpstreamFailure):
+		return "upstream-failure"
+	case errors.Is(err, ErrSchemaChanged):
+		return "schema-changed"
+	case errors.As(err, &se):
+		return "http-status"
+	case errors.As(err, &ne), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, context.DeadlineExceeded):
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+// snippet shortens a response for use in an error.
+func snippet(b []byte) string {
+	if len(b) > 64 {
+		return string(b[:64]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestDecodeJSONP(t *testing.T) {
+	testSet := []struct {
+		body     string
+		expected string
+	}{
+		{`callback_function({"success": true})`, `{"success": true}`},
+		{`raad071cal({"success": true});`, `{"success": true}`},
+		{"  jQuery123_456 ( {\"success\": true} ) ;\n", `{"success": true}`},
+		{`{"success": true}`, `{"success": true}`},
+		{"[]\r\n", `[]`},
+	}
+
+	for _, ts := range testSet {
+		payload, err := decodeJSONP([]byte(ts.body))
+		assert.Nil(t, err, "Unable to decode [%s]!", ts.body)
+		assert.Equal(t, ts.expected, string(payload), "Wrong payload for [%s]!", ts.body)
+	}
+}
+
+func TestDecodeJSONPShouldRejectOtherResponses(t *testing.T) {
+	testSet := []string{
+		"<html><body>502 Bad Gateway</body></html>",
+		"",
+		`callback_function({"success": true}`,
+		`callback_function({"bla": asfasdfasdf})`,
+		"Service unavailable",
+	}
+
+	for _, ts := range testSet {
+		_, err := decodeJSONP([]byte(ts))
+		assert.True(t, errors.Is(err, ErrNotJSONP), "Wrong error for [%s]: %+v", ts, err)
+	}
+}
+
+func TestDecodeCalendarMonth(t *testing.T) {
+	cm, err := decodeCalendarMonth([]byte(`{"success": true, "request": "x", "meetings": [{"id": 1}], "categories": []}`))
+	assert.Nil(t, err, "Unable to decode calendar month!")
+	assert.Equal(t, 1, len(cm.Meetings), "Wrong amount of meetings!")
+
+	testSet := []struct {
+		payload  string
+		expected error
+	}{
+		{`{"success": false, "request": "x", "message": "Eep!"}`, ErrUpstreamFailure},
+		{`{"meetings": []}`, ErrSchemaChanged},
+		{`{"success": "yes", "meetings": []}`, ErrSchemaChanged},
+		{`{"success": true}`, ErrSchemaChanged},
+		{`{"success": true, "meetings": {"id": 1}}`, ErrSchemaChanged},
+		{`[]`, ErrSchemaChanged},
+	}
+
+	for _, ts := range testSet {
+		_, err := decodeCalendarMonth([]byte(ts.payload))
+		assert.True(t, errors.Is(err, ts.expected), "Wrong error for [%s]: %+v", ts.payload, err)
+	}
+}
+
+func TestFailedMonthsShouldReportTheReason(t *testing.T) {
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		switch ym {
+		case yearMonth{2016, 1}:
+			io.WriteString(w, "<html><body>Onderhoud</body></html>")
+		case yearMonth{2016, 2}:
+			io.WriteString(w, `raad071cal({"success": false, "request": "x"});`)
+		case yearMonth{2016, 3}:
+			io.WriteString(w, `raad071cal({"success": true, "vergaderingen": []});`)
+		case yearMonth{2016, 4}:
+			http.NotFound(w, r)
+		default:
+			io.WriteString(w, `raad071cal({"success": true, "meetings": []});`)
+		}
+	})
+	defer srv.Close()
+
+	ps := newPollStatus(GetTestTime(), fetchCalendarItems(context.Background(), tt, GetTestTime()))
+
+	reasons := map[string]string{}
+	for _, ms := range ps.Months {
+		reasons[ms.Month] = ms.Reason
+	}
+	assert.Equal(t, "not-jsonp", reasons["2016-01"], "Wrong reason for an HTML page!")
+	assert.Equal(t, "upstream-failure", reasons["2016-02"], "Wrong reason for an unsuccessful response!")
+	assert.Equal(t, "schema-changed", reasons["2016-03"], "Wrong reason for a changed schema!")
+	assert.Equal(t, "http-status", reasons["2016-04"], "Wrong reason for a 404!")
+	assert.Equal(t, "", reasons["2016-05"], "Successful month has a reason!")
+	assert.Equal(t, 4, ps.Failed, "Wrong amount of failed months!")
+}
+
+func TestErrorReasonShouldTellNetworkErrorsApart(t *testing.T) {
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		dropConnection(w)
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := fetchCalendarMonthJSON(ctx, tt, yearMonth{2016, 8}, monthValidator{})
+	assert.Equal(t, "canceled", errorReason(err), "Wrong reason for a cancelled fetch!")
+
+	_, _, _, err = fetchOnce(context.Background(), tt.calendarURL(yearMonth{2016, 8}), monthValidator{})
+	assert.Equal(t, "network", errorReason(fmt.Errorf("Eep: %w", err)), "Wrong reason for a dropped connection!")
+
+	assert.Equal(t, "other", errorReason(errors.New("Eep!")), "Wrong reason for an unknown error!")
+}
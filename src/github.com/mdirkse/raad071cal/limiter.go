@@ -0,0 +1,130 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limits on the load we put on Notubiz
+var (
+	fetchConcurrency = 4   // months fetched at the same time, per tenant
+	fetchRate        = 2.0 // requests per second, shared by all tenants
+	fetchBurst       = 4   // requests that may be done at once after a quiet period
+
+	notubizLimiter = newRateLimiter(fetchRate, fetchBurst)
+)
+
+// rateLimiter is a token bucket. Every request takes a token; tokens are added at a fixed
+// rate up to the size of the bucket. A rate of 0 or less disables the limiter.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller has to wait before it may use it.
+// Callers are served in the order in which they reserve, as the bucket can go into debt.
+func (l *rateLimiter) reserve() time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel returns a token that was reserved but not used.
+func (l *rateLimiter) cancel() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tokens++
+}
+
+// wait blocks until a request may be done and returns how long that took.
+func (l *rateLimiter) wait(ctx context.Context) (time.Duration, error) {
+	d := l.reserve()
+	if d == 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return d, nil
+	case <-ctx.Done():
+		l.cancel()
+		return d, ctx.Err()
+	}
+}
+
+// queueWait sums up how long month fetches waited for a worker and for the rate limiter.
+type queueWait struct {
+	Waits        int     `json:"waits"`
+	TotalSeconds float64 `json:"totalSeconds"`
+	MaxSeconds   float64 `json:"maxSeconds"`
+}
+
+func (q *queueWait) add(d time.Duration) {
+	q.Waits++
+	q.TotalSeconds += d.Seconds()
+	if d.Seconds() > q.MaxSeconds {
+		q.MaxSeconds = d.Seconds()
+	}
+}
+
+// recordQueueWait records how long the fetch of a month waited.
+func (t *tenant) recordQueueWait(d time.Duration) {
+	queueWaitDuration.WithLabelValues(t.Name).Observe(d.Seconds())
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.queue.add(d)
+}
+
+// takeQueueWait returns the waits recorded since the previous call.
+func (t *tenant) takeQueueWait() queueWait {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	q := t.queue
+	t.queue = queueWait{}
+	return q
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterShouldAllowABurst(t *testing.T) {
+	l := newRateLimiter(1, 3)
+
+	for n := 0; n < 3; n++ {
+		assert.Equal(t, time.Duration(0), l.reserve(), "Request within the burst had to wait!")
+	}
+
+	d := l.reserve()
+	assert.True(t, d > 900*time.Millisecond && d <= time.Second, "Wrong wait after the burst: %s", d)
+
+	d = l.reserve()
+	assert.True(t, d > 1900*time.Millisecond && d <= 2*time.Second, "Waiting requests are not queued: %s", d)
+}
+
+func TestRateLimiterShouldBeDisabledWithoutRate(t *testing.T) {
+	l := newRateLimiter(0, 0)
+
+	for n := 0; n < 100; n++ {
+		assert.Equal(t, time.Duration(0), l.reserve(), "Disabled limiter made a request wait!")
+	}
+}
+
+func TestRateLimiterShouldWait(t *testing.T) {
+	l := newRateLimiter(50, 1)
+	l.reserve()
+
+	start := time.Now()
+	wait, err := l.wait(context.Background())
+
+	assert.Nil(t, err, "Unable to wait!")
+	assert.True(t, wait > 0, "No wait reported!")
+	assert.True(t, time.Since(start) >= wait-time.Millisecond, "Limiter didn't wait!")
+}
+
+func TestRateLimiterShouldReturnTokenWhenCancelled(t *testing.T) {
+	l := newRateLimiter(0.001, 1)
+	l.reserve()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := l.wait(ctx)
+	assert.Equal(t, context.Canceled, err, "Cancelled wait didn't fail!")
+
+	// The cancelled request should not push back the next one
+	d := l.reserve()
+	assert.True(t, d > 0 && d <= 1000*time.Second, "Cancelled request kept its token: %s", d)
+}
+
+func TestFetchCalendarItemsShouldBoundConcurrency(t *testing.T) {
+	defer func(c int) { fetchConcurrency = c }(fetchConcurrency)
+	fetchConcurrency = 3
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+
+		io.WriteString(w, `callback_function({"success": true, "meetings": []})`)
+	})
+	defer srv.Close()
+	waitsBefore := histogramCount(queueWaitDuration.WithLabelValues(tt.Name))
+
+	_, months, err := splitMonthResults(fetchCalendarItems(context.Background(), tt, GetTestTime()))
+
+	assert.Nil(t, err, "Unable to fetch calendar items!")
+	assert.Equal(t, generatedMonths, len(months), "Not all months were fetched!")
+	assert.Equal(t, 3, maxRunning, "Concurrency was not bounded!")
+
+	q := tt.takeQueueWait()
+	assert.Equal(t, generatedMonths, q.Waits, "Queue waits not recorded once per month!")
+	assert.Equal(t, uint64(generatedMonths), histogramCount(queueWaitDuration.WithLabelValues(tt.Name))-waitsBefore, "Queue waits not exported!")
+	assert.True(t, q.MaxSeconds > 0, "Queued months didn't wait!")
+	assert.Equal(t, queueWait{}, tt.takeQueueWait(), "Queue waits not reset!")
+}
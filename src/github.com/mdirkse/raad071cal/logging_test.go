@@ -0,0 +1,154 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureLogs makes the default logger write JSON lines at debug level to the returned function,
+// which returns the lines that were logged so far.
+func captureLogs(t *testing.T) func() []map[string]interface{} {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	var mutex sync.Mutex
+	var b bytes.Buffer
+	h, _ := newLogHandler(lockedWriter{&mutex, &b}, "json", "debug")
+	slog.SetDefault(slog.New(h))
+
+	return func() []map[string]interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var lines []map[string]interface{}
+		for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			var line map[string]interface{}
+			if json.Unmarshal([]byte(l), &line) == nil {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+}
+
+type lockedWriter struct {
+	mutex *sync.Mutex
+	w     io.Writer
+}
+
+func (l lockedWriter) Write(b []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.w.Write(b)
+}
+
+func TestNewLogHandlerShouldValidateSettings(t *testing.T) {
+	_, err := newLogHandler(io.Discard, "json", "warn")
+	assert.Nil(t, err, "Valid settings were rejected!")
+
+	_, err = newLogHandler(io.Discard, "xml", "info")
+	assert.NotNil(t, err, "Unknown format was accepted!")
+
+	_, err = newLogHandler(io.Discard, "text", "loud")
+	assert.NotNil(t, err, "Unknown level was accepted!")
+}
+
+func TestAccessLogShouldHaveTheRequestID(t *testing.T) {
+	logs := captureLogs(t)
+
+	h := loggingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger(r.Context()).Info("Inside")
+		http.Error(w, "Nope", http.StatusTeapot)
+	}))
+
+	req, _ := http.NewRequest("GET", "/kalender/alles.ics", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, "abc-123", w.Header().Get(requestIDHeader), "Request ID not returned!")
+
+	lines := logs()
+	if assert.Equal(t, 2, len(lines), "Wrong amount of log lines!") {
+		assert.Equal(t, "abc-123", lines[0]["request_id"], "Request ID not propagated!")
+		assert.Equal(t, "abc-123", lines[1]["request_id"], "Request ID not in the access log!")
+		assert.Equal(t, float64(http.StatusTeapot), lines[1]["status"], "Status not in the access log!")
+		assert.Equal(t, float64(5), lines[1]["bytes"], "Size not in the access log!")
+		assert.Contains(t, lines[1], "duration_ms", "Latency not in the access log!")
+	}
+}
+
+func TestAccessLogShouldReplaceInvalidRequestIDs(t *testing.T) {
+	captureLogs(t)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "evil\" id=1")
+	w := httptest.NewRecorder()
+	loggingHandler(http.NotFoundHandler()).ServeHTTP(w, req)
+
+	assert.Regexp(t, "^[0-9a-f]{16}$", w.Header().Get(requestIDHeader), "Invalid request ID was used!")
+}
+
+func TestPollLinesShouldHaveThePollID(t *testing.T) {
+	logs := captureLogs(t)
+	store = newMemoryStore()
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if ym.month == 3 {
+			io.WriteString(w, "<html>Eep!</html>")
+			return
+		}
+		io.WriteString(w, `callback_function({"success": true, "meetings": [{"id": 1, "date": "1-1-bla", "time": "20:00", "documents": []}]})`)
+	})
+	defer srv.Close()
+
+	loadCalendarItems(context.Background(), tt)
+	id := tt.pollStatus().ID
+
+	var fetches, enrich, failed int
+	for _, l := range logs() {
+		if _, ok := l["month"]; !ok {
+			continue
+		}
+		assert.Equal(t, id, l["poll_id"], "Line without the poll ID: %v", l)
+		assert.Equal(t, "leiden", l["gemeente"], "Line without the tenant: %v", l)
+
+		switch l["msg"] {
+		case "Fetched month":
+			fetches++
+		case "Unable to enrich meeting":
+			enrich++
+			assert.Equal(t, float64(1), l["meeting"], "Meeting ID not logged!")
+		case "Unable to fetch month":
+			failed++
+			assert.Equal(t, "not-jsonp", l["reason"], "Wrong reason!")
+		}
+	}
+
+	assert.NotEmpty(t, id, "Poll has no ID!")
+	assert.Equal(t, generatedMonths, fetches, "Fetches not logged!")
+	assert.Equal(t, generatedMonths-1, enrich, "Enrich errors not logged!")
+	assert.Equal(t, 1, failed, "Failed month not logged!")
+}
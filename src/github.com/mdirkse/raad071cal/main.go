@@ -14,114 +14,345 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"flag"
+	"fmt"
 	"github.com/robfig/cron"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"sync"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-const (
-	listenAddress      = ":80"
-	raad071CalendarURL = "http://leiden.notudoc.nl/cgi-bin/calendar.cgi"
-	calendarHeader     = `BEGIN:VCALENDAR
-VERSION:2.0
-PRODID:-//mdirkse/raad071cal//NONSGML v1.0//EN
-URL:http://raad071.mdirkse.nl/kalender/alles.ics
-NAME:#raad071 kalender
-X-WR-CALNAME:#raad071 kalender
-DESCRIPTION:De politieke agenda van de Leidse gemeenteraad
-X-WR-CALDESC:De politieke agenda van de Leidse gemeenteraad
-X-PUBLISHED-TTL:PT6H
-`
-	calendarFooter = "END:VCALENDAR"
+var listenAddress = ":80"
+
+// The feed window, in whole months around the current month. Older items are kept in the store.
+var (
+	feedMonthsBack  = 5
+	feedMonthsAhead = 12
 )
 
+// feed holds the metadata that goes into the header of a rendered calendar.
+type feed struct {
+	URL         string
+	Name        string
+	Description string
+}
+
 var (
-	calItems []CalItem
-	cestTz   *time.Location
-	cronT    *cron.Cron
-	mutex    sync.RWMutex
+	cestTz  *time.Location
+	cronT   *cron.Cron
+	tenants []*tenant
+	utcMode bool // render times in UTC instead of Europe/Amsterdam
+
+	prefixCancelled bool          // prefix the summary of cancelled meetings for clients that ignore STATUS
+	cancelledGrace  time.Duration // how long cancelled meetings stay in the feed, 0 means forever
+
+	store Store
 )
 
 func main() {
 	initCalFetcherVars()
-	log.Println("Starting raad071cal")
 
-	// Configure periodic polling
-	log.Printf("Polling source calendar [%s] every 6 hours.", raad071CalendarURL)
-	cronT.AddFunc("1 1 */6 * * *", loadCalendarItems)
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfill(os.Args[2:]); err != nil {
+			fatal("Backfill failed", "err", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfig(os.Args[2:]); err != nil {
+			fatal("Invalid configuration", "err", err)
+		}
+		return
+	}
+
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+	cfg.apply()
+
+	slog.Info("Starting raad071cal")
+
+	if tenants, err = cfg.tenants(); err != nil {
+		fatal("Invalid tenant list", "err", err)
+	}
+
+	if cfg.DataDir == "" {
+		store = newMemoryStore()
+	} else if store, err = openBoltStore(cfg.DataDir); err != nil {
+		fatal("Unable to open the store", "dir", cfg.DataDir, "err", err)
+	}
+	defer store.Close()
+
+	// Serve whatever we already have while the first fetch is running, which only asks Notubiz
+	// for the months that changed since they were stored
+	for _, t := range tenants {
+		if vs, err := store.Validators(t.Name); err != nil {
+			slog.Warn("Unable to read the validators from the store", "gemeente", t.Name, "err", err)
+		} else {
+			t.setMonthValidators(vs)
+		}
+		refreshFeed(t, time.Now())
+		if len(t.calItems()) > 0 {
+			t.markLoaded(time.Time{})
+		}
+	}
+
+	// Polls are cancelled on shutdown
+	pollCtx, stopPolls := context.WithCancel(context.Background())
+	defer stopPolls()
+
+	for _, t := range tenants {
+		// Configure periodic polling
+		t := t
+		slog.Info("Polling source calendar", "gemeente", t.Name, "host", t.Host, "schedule", t.PollSpec)
+		if err := cronT.AddFunc(t.PollSpec, func() { t.refresh(pollCtx) }); err != nil {
+			fatal("Invalid poll schedule", "gemeente", t.Name, "err", err)
+		}
+
+		cal, committee, archive := "/kalender/"+t.Name+"/alles.ics", "/kalender/"+t.Name+"/commissie/", "/kalender/"+t.Name+"/archief/"
+		http.Handle(cal, loggingHandler(countingHandler(cal, loadedHandler(t, calHandler(t)))))
+		for _, cf := range []calFormat{formatJCal, formatXCal} {
+			p := "/kalender/" + t.Name + "/alles." + cf.ext
+			http.Handle(p, loggingHandler(countingHandler(p, loadedHandler(t, calFormatHandler(t, cf)))))
+		}
+		http.Handle(committee, loggingHandler(countingHandler(committee, loadedHandler(t, committeeHandler(t, committee)))))
+		http.Handle(archive, loggingHandler(countingHandler(archive, loadedHandler(t, archiveHandler(t, archive)))))
+	}
 	cronT.Start()
 
-	http.Handle("/kalender/alles.ics", loggingHandler(calHandler()))
+	// The original feed URLs keep serving the first tenant
+	http.Handle("/kalender/alles.ics", loggingHandler(countingHandler("/kalender/alles.ics", loadedHandler(tenants[0], calHandler(tenants[0])))))
+	for _, cf := range []calFormat{formatJCal, formatXCal} {
+		p := "/kalender/alles." + cf.ext
+		http.Handle(p, loggingHandler(countingHandler(p, loadedHandler(tenants[0], calFormatHandler(tenants[0], cf)))))
+	}
+	http.Handle("/kalender/commissie/", loggingHandler(countingHandler("/kalender/commissie/", loadedHandler(tenants[0], committeeHandler(tenants[0], "/kalender/commissie/")))))
+	http.Handle("/kalender/archief/", loggingHandler(countingHandler("/kalender/archief/", loadedHandler(tenants[0], archiveHandler(tenants[0], "/kalender/archief/")))))
+	http.Handle(eventPrefix, loggingHandler(countingHandler(eventPrefix, eventHandler(tenants))))
+	http.Handle(meetingPrefix, loggingHandler(countingHandler(meetingPrefix, meetingHandler(tenants))))
+	http.Handle(apiMeetingsPath, loggingHandler(countingHandler(apiMeetingsPath, meetingsHandler(tenants))))
+	http.Handle(apiMeetingsPath+"/", loggingHandler(countingHandler(apiMeetingsPath+"/", meetingsHandler(tenants))))
+	http.Handle(apiOpenAPIPath, loggingHandler(countingHandler(apiOpenAPIPath, openAPIHandler())))
+	http.Handle("/status", loggingHandler(countingHandler("/status", statusHandler(tenants))))
+	http.Handle("/metrics", metricsHandler(tenants))
+	http.Handle("/healthz", healthzHandler())
+	http.Handle("/readyz", readyzHandler(tenants))
+	if adminToken != "" {
+		http.Handle("/admin/refresh", loggingHandler(adminHandler(refreshHandler(pollCtx, tenants))))
+		http.Handle("/admin/status", loggingHandler(adminHandler(adminStatusHandler(tenants))))
+	} else {
+		slog.Info("No admin token configured, the /admin endpoints are disabled")
+	}
 	http.Handle("/", loggingHandler(http.FileServer(http.Dir("html"))))
 
-	log.Printf("Fully initialised and listening on [%s].", listenAddress)
-	go loadCalendarItems() // do initial load
+	l, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		fatal("Unable to listen", "listen", listenAddress, "err", err)
+	}
 
-	http.ListenAndServe(listenAddress, nil)
+	slog.Info("Fully initialised", "listen", listenAddress)
+	for _, t := range tenants {
+		go t.refresh(pollCtx) // do initial load
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := serve(ctx, &http.Server{}, l, stopPolls, tenants); err != nil {
+		slog.Error("Unclean shutdown", "err", err)
+	} else {
+		slog.Info("Shut down")
+	}
 }
 
 func initCalFetcherVars() {
 	cestTz, _ = time.LoadLocation("Europe/Amsterdam")
 	cronT = cron.New()
+}
+
+func loadCalendarItems(ctx context.Context, t *tenant) {
+	fetchStart := time.Now()
+
+	// Every line logged during the poll carries its ID, including those of the fetch workers
+	pollID := newRunID()
+	ctx = withLogger(ctx, logger(ctx).With("gemeente", t.Name, "poll_id", pollID))
+	l := logger(ctx)
+	l.Info("Polling Notubiz")
+
+	results := fetchCalendarItems(ctx, t, fetchStart)
+	ps := newPollStatus(fetchStart, results)
+	ps.ID = pollID
+	ps.QueueWait = t.takeQueueWait()
+	t.setPollStatus(ps)
+	pollDuration.WithLabelValues(t.Name).Observe(ps.Finished.Sub(ps.Started).Seconds())
+	if !ps.Drift.empty() {
+		l.Warn("The Notubiz response differs from the schema", "drift", ps.Drift.String())
+	}
 
-	calItems = []CalItem{}
+	newCalItems, months, err := splitMonthResults(results)
+	if ps.Abandoned {
+		l.Error("Unable to fetch any calendar items, not updating the feed", "err", err)
+		t.setLastError(err)
+		polls.WithLabelValues(t.Name, "abandoned").Inc()
+		return
+	}
+	result := "ok"
+	if err != nil {
+		l.Error("Unable to fetch all calendar items, keeping the previous items of the failed months", "failed", ps.Failed, "err", err)
+		t.setLastError(err)
+		result = "partial"
+	}
+	l.Info("Polled Notubiz", "months", len(results), "unchanged", ps.Unchanged, "failed", ps.Failed,
+		"duration_ms", float64(ps.Finished.Sub(ps.Started).Microseconds())/1000)
 
-	initCalItemVars()
+	// Only the months that were fetched successfully and have changed are replaced
+	if len(months) > 0 || len(newCalItems) > 0 {
+		if _, err := store.Replace(t.Name, months, newCalItems, fetchStart); err != nil {
+			l.Error("Unable to store the calendar items, not updating the feed", "err", err)
+			t.setLastError(err)
+			polls.WithLabelValues(t.Name, "failed").Inc()
+			return
+		}
+	}
+	validators := monthValidators(results)
+	if err := store.SetValidators(t.Name, validators); err != nil {
+		l.Warn("Unable to store the validators, the months are fetched in full after a restart", "err", err)
+	}
+	t.setMonthValidators(validators)
+
+	refreshFeed(t, fetchStart)
+	if result == "ok" {
+		t.markLoaded(fetchStart)
+	} else {
+		// The feed has data, but the failed months may be outdated
+		t.markLoaded(time.Time{})
+	}
+	polls.WithLabelValues(t.Name, result).Inc()
 }
 
-func loadCalendarItems() {
-	newCalItems, err := fetchCalendarItems(time.Now())
+// refreshFeed loads the items in the feed window from the store.
+func refreshFeed(t *tenant, now time.Time) {
+	from, to := feedWindow(now)
+
+	items, err := store.Range(t.Name, from, to)
 	if err != nil {
-		log.Printf("ERROR - Unable to fetch all calendar items! Not updating iCal. Error: [%+v]", err)
+		slog.Error("Unable to read the calendar items from the store", "gemeente", t.Name, "err", err)
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	calItems = newCalItems
+	t.setCalItems(feedFilter.apply(dropExpiredCancellations(dropRemoved(items), now, cancelledGrace)))
+	prerenderFeed(t)
+}
+
+// prerenderFeed renders the unfiltered iCalendar feed of the current snapshot, so the first
+// request after a poll doesn't have to wait for it. Other variants are rendered when first requested.
+func prerenderFeed(t *tenant) {
+	s := t.snapshot()
+	rf := t.feeds.get(feedKey(formatICal, url.Values{}), s, func(w io.Writer) error {
+		return renderCalendarAs(formatICal, t.feed(), s.items, w)
+	})
+	if rf.err != nil {
+		slog.Error("Unable to render the feed", "gemeente", t.Name, "err", rf.err)
+	}
+}
+
+// feedKey returns the key of a feed variant in the feed cache.
+func feedKey(cf calFormat, query url.Values) string {
+	return "alles." + cf.ext + "?" + query.Encode()
+}
+
+// feedWindow returns the period that the feeds cover, from the start of the month feedMonthsBack
+// months ago up to the end of the month feedMonthsAhead months ahead.
+func feedWindow(now time.Time) (time.Time, time.Time) {
+	now = now.In(cestTz)
+	som := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, cestTz)
+
+	return som.AddDate(0, -feedMonthsBack, 0), som.AddDate(0, feedMonthsAhead+1, 0)
 }
 
-func loggingHandler(h http.Handler) http.Handler {
+// calHandler serves the feed in the format that the client asks for in its Accept header.
+func calHandler(t *tenant) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[%s] [%s] %s", r.RemoteAddr, r.Method, r.URL.Path)
-		h.ServeHTTP(w, r)
+		w.Header().Set("Vary", "Accept")
+		serveCalendar(w, r, t, negotiateFormat(r.Header.Get("Accept")))
 	})
 }
 
-func calHandler() http.Handler {
+// calFormatHandler serves the feed in the given format, eg. on /kalender/alles.json.
+func calFormatHandler(t *tenant, cf calFormat) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/calendar")
-		w.Header().Set("Cache-Control", "max-age=3600")
+		serveCalendar(w, r, t, cf)
+	})
+}
+
+func serveCalendar(w http.ResponseWriter, r *http.Request, t *tenant, cf calFormat) {
+	s := t.snapshot()
+	items := s.items
 
-		if err := renderCalendar(calItems, w); err != nil {
-			http.Error(w, "Couldn't render calendar items!", http.StatusInternalServerError)
+	// Every filter is a variant of the feed; the encoded query is sorted by parameter
+	query := r.URL.Query()
+	if len(query) > 0 {
+		f, err := parseItemFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		items = f.apply(items)
+	}
+
+	t.serveFeed(w, r, s, feedKey(cf, query), cf.contentType, func(w io.Writer) error {
+		return renderCalendarAs(cf, t.feed(), items, w)
 	})
 }
 
-func renderCalendar(items []CalItem, w io.Writer) error {
-	start := time.Now()
+// calendarComponent returns the iCalendar representation of a feed with the given items.
+func calendarComponent(f feed, items []CalItem) icalComponent {
+	c := icalComponent{Name: "VCALENDAR"}
 
-	_, err := io.WriteString(w, calendarHeader)
+	c.add(textProp("VERSION", "2.0"))
+	c.add(textProp("PRODID", "-//mdirkse/raad071cal//NONSGML v1.0//EN"))
+	c.add(uriProp("URL", f.URL))
+	c.add(textProp("NAME", f.Name))
+	c.add(textProp("X-WR-CALNAME", f.Name))
+	c.add(textProp("DESCRIPTION", f.Description))
+	c.add(textProp("X-WR-CALDESC", f.Description))
+	c.add(icalProperty{Name: "X-PUBLISHED-TTL", Type: icalDuration, Value: "PT6H"})
 
-	if err != nil {
-		return errors.New("Could not write calendar!")
+	if from, to, ok := timedRange(items); ok && !utcMode {
+		c.add(textProp("X-WR-TIMEZONE", cestTz.String()))
+		c.Components = append(c.Components, vtimezone(cestTz, from, to))
 	}
 
-	mutex.RLock()
-	for _, c := range items {
-		c.RenderItem(w)
-		io.WriteString(w, "\n")
+	for _, i := range items {
+		c.Components = append(c.Components, i.vevent())
 	}
-	mutex.RUnlock()
 
-	io.WriteString(w, calendarFooter)
+	return c
+}
+
+func renderCalendar(f feed, items []CalItem, w io.Writer) error {
+	return renderCalendarAs(formatICal, f, items, w)
+}
+
+// renderCalendarAs writes the calendar in the given format.
+func renderCalendarAs(cf calFormat, f feed, items []CalItem, w io.Writer) error {
+	start := time.Now()
+
+	if err := cf.encode(calendarComponent(f, items), w); err != nil {
+		return fmt.Errorf("Could not write calendar: %+v", err)
+	}
 
-	log.Printf("Rendered iCal calendar in %0.3f seconds.", time.Since(start).Seconds())
+	renderDuration.Observe(time.Since(start).Seconds())
+	slog.Debug("Rendered calendar", "feed", f.Name, "format", cf.ext, "items", len(items), "duration_ms", float64(time.Since(start).Microseconds())/1000)
 
 	return nil
 }
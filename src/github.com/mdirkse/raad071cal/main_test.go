@@ -15,15 +15,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
 	initCalFetcherVars()
+	store = newMemoryStore()
+	fetchBackoff = time.Millisecond
+	notubizLimiter = newRateLimiter(0, 0)
 	code := m.Run()
 	os.Exit(code)
 }
@@ -31,27 +37,20 @@ func TestMain(m *testing.M) {
 func TestRenderCalendarShouldYieldCorrectOutput(t *testing.T) {
 	testCals := []CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()}
 
-	var testICal bytes.Buffer
-	testICal.WriteString(calendarHeader)
-	for _, c := range testCals {
-		c.RenderItem(&testICal)
-		testICal.WriteByte('\n')
-	}
-	testICal.WriteString(calendarFooter)
-
-	emptyCal := calendarHeader + calendarFooter
+	fullCal := GetRenderedTestHeader() + "X-WR-TIMEZONE:Europe/Amsterdam\r\n" + GetRenderedTestTimezone() + GetRenderedTestItem1() + GetRenderedTestItem2() + GetRenderedTestItem3() + "END:VCALENDAR\r\n"
+	emptyCal := GetRenderedTestHeader() + "END:VCALENDAR\r\n"
 
 	var iCals = []struct {
 		expected string
 		items    []CalItem
 	}{
-		{testICal.String(), testCals},
+		{fullCal, testCals},
 		{emptyCal, []CalItem{}},
 	}
 
 	for _, ct := range iCals {
 		var result bytes.Buffer
-		renderCalendar(ct.items, &result)
+		renderCalendar(GetTestTenant().feed(), ct.items, &result)
 
 		assert.Equal(t, ct.expected, result.String(), "Render went awry!")
 	}
@@ -61,8 +60,87 @@ func TestHttpEndpointRequestShouldYieldCorrectOutput(t *testing.T) {
 	req, _ := http.NewRequest("GET", "http://bla.com", nil)
 
 	w := httptest.NewRecorder()
-	calHandler().ServeHTTP(w, req)
+	calHandler(GetTestTenant()).ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code, "Request returned incorrect status!")
-	assert.Equal(t, calendarHeader+calendarFooter, w.Body.String(), "Request went awry!")
+	assert.Equal(t, GetRenderedTestHeader()+"END:VCALENDAR\r\n", w.Body.String(), "Request went awry!")
+}
+
+func TestRefreshFeedShouldRenderTheFullFeed(t *testing.T) {
+	store = newMemoryStore()
+	tt := GetTestTenant()
+	refreshFeed(tt, GetTestTime())
+
+	rf, ok := tt.feeds.entries["alles.ics?"]
+	assert.True(t, ok, "Feed was not rendered!")
+	assert.Equal(t, tt.snapshot(), rf.snapshot, "Feed was rendered from the wrong snapshot!")
+	assert.Contains(t, string(rf.bodies[encodingIdentity]), "END:VCALENDAR", "Feed was rendered incorrectly!")
+}
+
+func TestLoadCalendarItemsShouldKeepFailedMonths(t *testing.T) {
+	store = newMemoryStore()
+	var failing yearMonth
+	failAll := false
+	version := "v1"
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if failAll || ym == failing {
+			http.Error(w, "Eep!", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `callback_function({"success": true, "meetings": [{"id": %d%02d, "canceled": false, "description": "Gemeenteraad %s", "location": "", "documents": [], "date": "15-%02d-%d", "time": "20:00"}]})`, ym.year, ym.month, version, ym.month, ym.year)
+	})
+	defer srv.Close()
+
+	loadCalendarItems(context.Background(), tt)
+	assert.Equal(t, 18, len(tt.calItems()), "Wrong amount of items after the first poll!")
+
+	// One month fails, the rest is updated
+	failedMonth := generateMonthYearRange(time.Now())[7]
+	failing = failedMonth
+	version = "v2"
+	loadCalendarItems(context.Background(), tt)
+
+	items := tt.calItems()
+	assert.Equal(t, 18, len(items), "Wrong amount of items after a partial failure!")
+	for _, i := range items {
+		if itemMonth(i) == failedMonth {
+			assert.Equal(t, "Gemeenteraad v1", i.Description, "Failed month was not kept!")
+		} else {
+			assert.Equal(t, "Gemeenteraad v2", i.Description, "Successful month was not updated!")
+		}
+	}
+	assert.Equal(t, 1, tt.pollStatus().Failed, "Failed month not in the status!")
+
+	// Everything fails, nothing changes
+	failAll = true
+	version = "v3"
+	loadCalendarItems(context.Background(), tt)
+
+	assert.Equal(t, items, tt.calItems(), "Items changed even though all months failed!")
+	assert.True(t, tt.pollStatus().Abandoned, "Abandoned poll not in the status!")
+}
+
+func GetRenderedTestTimezone() string {
+	return crlf(`BEGIN:VTIMEZONE
+TZID:Europe/Amsterdam
+BEGIN:DAYLIGHT
+DTSTART:20160327T020000
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+TZNAME:CEST
+END:DAYLIGHT
+END:VTIMEZONE`)
+}
+
+func GetRenderedTestHeader() string {
+	return crlf(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//mdirkse/raad071cal//NONSGML v1.0//EN
+URL:http://raad071.mdirkse.nl/kalender/leiden/alles.ics
+NAME:#raad071 kalender
+X-WR-CALNAME:#raad071 kalender
+DESCRIPTION:De politieke agenda van de Leidse gemeenteraad
+X-WR-CALDESC:De politieke agenda van de Leidse gemeenteraad
+X-PUBLISHED-TTL:PT6H`)
 }
@@ -0,0 +1,189 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Buckets for durations, from 5ms up to a minute.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "raad071cal_upstream_request_duration_seconds",
+		Help:    "Duration of requests to Notubiz, by month and response status.",
+		Buckets: durationBuckets,
+	}, []string{"gemeente", "month", "status"})
+	monthErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raad071cal_month_errors_total",
+		Help: "Months that could not be fetched or parsed, by reason.",
+	}, []string{"gemeente", "reason"})
+	enrichErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raad071cal_enrich_errors_total",
+		Help: "Meetings that were skipped because they could not be decoded or enriched.",
+	}, []string{"gemeente"})
+	polls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raad071cal_polls_total",
+		Help: "Polls of Notubiz, by result (ok, partial, abandoned or failed).",
+	}, []string{"gemeente", "result"})
+	queueWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "raad071cal_queue_wait_seconds",
+		Help:    "Time that the fetch of a month waited for a worker and for the rate limiter.",
+		Buckets: durationBuckets,
+	}, []string{"gemeente"})
+	pollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "raad071cal_poll_duration_seconds",
+		Help:    "Duration of fetching all months of a poll.",
+		Buckets: durationBuckets,
+	}, []string{"gemeente"})
+	renderDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "raad071cal_render_duration_seconds",
+		Help:    "Duration of rendering a calendar.",
+		Buckets: durationBuckets,
+	})
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raad071cal_http_requests_total",
+		Help: "Requests to the feeds and other endpoints, by status code.",
+	}, []string{"endpoint", "code"})
+)
+
+// observeUpstream records the duration and outcome of a request to Notubiz for a month.
+func observeUpstream(t *tenant, ym yearMonth, d time.Duration, body []byte, err error) {
+	var se upstreamStatusError
+	status := "200"
+	switch {
+	case errors.As(err, &se):
+		status = strconv.Itoa(se.StatusCode)
+	case err != nil:
+		status = "error"
+	case body == nil:
+		status = "304"
+	}
+
+	upstreamDuration.WithLabelValues(t.Name, ym.String(), status).Observe(d.Seconds())
+}
+
+// forgetUpstreamMonth drops the upstream metrics of a month that is no longer fetched, so the
+// month label doesn't grow without bounds.
+func forgetUpstreamMonth(t *tenant, ym yearMonth) {
+	upstreamDuration.DeletePartialMatch(prometheus.Labels{"gemeente": t.Name, "month": ym.String()})
+}
+
+// statusRecorder remembers the status code and the size of the response that a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// countingHandler counts the requests to an endpoint by status code.
+func countingHandler(endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		httpRequests.WithLabelValues(endpoint, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// metricsHandler exposes the metrics in the Prometheus formats. The state of the tenants
+// (items, data age, the outcome of the last poll) is read at scrape time.
+func metricsHandler(ts []*tenant) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(polls, monthErrors, enrichErrors, httpRequests, upstreamDuration, queueWaitDuration, pollDuration, renderDuration, tenantCollector(ts))
+
+	h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelError)})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		h.ServeHTTP(w, r)
+	})
+}
+
+var (
+	dataAgeDesc = prometheus.NewDesc("raad071cal_data_age_seconds",
+		"Time since the last successful poll.", []string{"gemeente"}, nil)
+	feedItemsDesc = prometheus.NewDesc("raad071cal_feed_items",
+		"Meetings in the feed, by committee (none for plenary meetings).", []string{"gemeente", "category"}, nil)
+	monthFetchOKDesc = prometheus.NewDesc("raad071cal_month_fetch_ok",
+		"Whether a month was fetched successfully during the last poll.", []string{"gemeente", "month"}, nil)
+	schemaDriftDesc = prometheus.NewDesc("raad071cal_schema_drift_fields",
+		"Fields that differ from the Notubiz schema during the last poll, by kind.", []string{"gemeente", "kind"}, nil)
+)
+
+// tenantCollector collects the metrics that describe the current state of the tenants.
+type tenantCollector []*tenant
+
+func (ts tenantCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{dataAgeDesc, feedItemsDesc, monthFetchOKDesc, schemaDriftDesc} {
+		ch <- d
+	}
+}
+
+func (ts tenantCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	for _, t := range ts {
+		if last := t.lastSuccessfulPoll(); !last.IsZero() {
+			ch <- prometheus.MustNewConstMetric(dataAgeDesc, prometheus.GaugeValue, now.Sub(last).Seconds(), t.Name)
+		}
+
+		counts := make(map[string]float64)
+		for _, i := range t.calItems() {
+			c := strings.ToLower(i.Committee.Short)
+			if i.Committee.ID == 0 || c == "" {
+				c = "none"
+			}
+			counts[c]++
+		}
+		for c, n := range counts {
+			ch <- prometheus.MustNewConstMetric(feedItemsDesc, prometheus.GaugeValue, n, t.Name, c)
+		}
+
+		ps := t.pollStatus()
+		for _, ms := range ps.Months {
+			ok := 0.0
+			if ms.OK {
+				ok = 1
+			}
+			ch <- prometheus.MustNewConstMetric(monthFetchOKDesc, prometheus.GaugeValue, ok, t.Name, ms.Month)
+		}
+
+		for _, k := range []struct {
+			kind   string
+			fields map[string]int
+		}{{"unknown", ps.Drift.Unknown}, {"missing", ps.Drift.Missing}, {"mismatched", ps.Drift.Mismatched}} {
+			if len(k.fields) > 0 {
+				ch <- prometheus.MustNewConstMetric(schemaDriftDesc, prometheus.GaugeValue, float64(len(k.fields)), t.Name, k.kind)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func counterValue(c prometheus.Counter) float64 {
+	var d dto.Metric
+	c.Write(&d)
+	return d.GetCounter().GetValue()
+}
+
+func histogramCount(o prometheus.Observer) uint64 {
+	var d dto.Metric
+	o.(prometheus.Metric).Write(&d)
+	return d.GetHistogram().GetSampleCount()
+}
+
+// upstreamRequests returns the number of requests to Notubiz with the given labels, over all
+// label values that aren't given.
+func upstreamRequests(labels prometheus.Labels) uint64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		upstreamDuration.Collect(ch)
+		close(ch)
+	}()
+
+	var count uint64
+	for m := range ch {
+		var d dto.Metric
+		m.Write(&d)
+
+		matches := 0
+		for _, lp := range d.GetLabel() {
+			if v, ok := labels[lp.GetName()]; ok && v == lp.GetValue() {
+				matches++
+			}
+		}
+		if matches == len(labels) {
+			count += d.GetHistogram().GetSampleCount()
+		}
+	}
+	return count
+}
+
+func TestPollShouldBeMeasured(t *testing.T) {
+	store = newMemoryStore()
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		if ym.month == 1 {
+			http.Error(w, "Eep!", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, `callback_function({"success": true, "meetings": []})`)
+	})
+	defer srv.Close()
+	tt.Name = "metrics-test"
+
+	var january yearMonth
+	for _, ym := range generateMonthYearRange(time.Now()) {
+		if ym.month == 1 {
+			january = ym
+		}
+	}
+
+	// The metrics are global, so only the difference is checked
+	failedLabels := prometheus.Labels{"gemeente": "metrics-test", "month": january.String(), "status": "404"}
+	okLabels := prometheus.Labels{"gemeente": "metrics-test", "status": "200"}
+	pollsBefore := counterValue(polls.WithLabelValues("metrics-test", "partial"))
+	errorsBefore := counterValue(monthErrors.WithLabelValues("metrics-test", "http-status"))
+	failedBefore := upstreamRequests(failedLabels)
+	okBefore := upstreamRequests(okLabels)
+
+	loadCalendarItems(context.Background(), tt)
+
+	assert.Equal(t, float64(1), counterValue(polls.WithLabelValues("metrics-test", "partial"))-pollsBefore, "Poll not counted!")
+	assert.Equal(t, float64(1), counterValue(monthErrors.WithLabelValues("metrics-test", "http-status"))-errorsBefore, "Failed month not counted!")
+	assert.Equal(t, uint64(1), upstreamRequests(failedLabels)-failedBefore, "Failed request not measured!")
+	assert.Equal(t, uint64(generatedMonths-1), upstreamRequests(okLabels)-okBefore, "Requests not measured!")
+}
+
+func TestUpstreamMetricsOfOldMonthsShouldBeForgotten(t *testing.T) {
+	tt := GetTestTenant()
+	tt.Name = "forget-test"
+	nextLabels := prometheus.Labels{"gemeente": "forget-test", "month": testMonthNext.String()}
+	nextBefore := upstreamRequests(nextLabels)
+
+	observeUpstream(tt, testMonth, time.Second, []byte{}, nil)
+	observeUpstream(tt, testMonthNext, time.Second, []byte{}, nil)
+
+	forgetUpstreamMonth(tt, testMonth)
+
+	assert.Equal(t, uint64(0), upstreamRequests(prometheus.Labels{"gemeente": "forget-test", "month": testMonth.String()}), "Old month not forgotten!")
+	assert.Equal(t, uint64(1), upstreamRequests(nextLabels)-nextBefore, "Current month forgotten!")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tt := GetTestTenant()
+	tt.setCalItems([]CalItem{GetTestItem1(), GetTestItem2(), GetTestItem3()})
+	tt.markLoaded(time.Now().Add(-time.Minute))
+
+	h := countingHandler("/kalender/alles.ics", calHandler(tt))
+	req, _ := http.NewRequest("GET", "/kalender/alles.ics?bla=1", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	metricsHandler([]*tenant{tt}).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "Metrics not served!")
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"), "Metrics may be cached!")
+	assert.Contains(t, w.Body.String(), `raad071cal_http_requests_total{code="400",endpoint="/kalender/alles.ics"}`, "Feed request not counted!")
+	assert.Contains(t, w.Body.String(), `raad071cal_feed_items{category="none",gemeente="leiden"}`, "Items not counted!")
+	assert.Contains(t, w.Body.String(), `raad071cal_data_age_seconds{gemeente="leiden"} 6`, "Data age missing!")
+}
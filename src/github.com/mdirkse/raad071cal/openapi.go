@@ -0,0 +1,133 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// openAPISpec describes version 1 of the API, served at /api/v1/openapi.json. Keep the schemas
+// in line with apiMeeting and apiMeetingList.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "raad071cal",
+    "description": "The meetings of the municipal councils in the Leiden region, as published in Notubiz.",
+    "version": "1.0.0"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "paths": {
+    "/meetings": {
+      "get": {
+        "summary": "List meetings",
+        "description": "Returns the meetings that match the parameters, ordered by start time. Without a date range the meetings in the window of the calendar feeds are returned.",
+        "operationId": "listMeetings",
+        "parameters": [
+          {"name": "gemeente", "in": "query", "description": "Comma separated municipalities, eg. leiden,oegstgeest. Defaults to all of them.", "schema": {"type": "string"}},
+          {"name": "from", "in": "query", "description": "First day (inclusive) on which meetings start.", "schema": {"type": "string", "format": "date"}},
+          {"name": "to", "in": "query", "description": "Last day (inclusive) on which meetings start.", "schema": {"type": "string", "format": "date"}},
+          {"name": "committee", "in": "query", "description": "Comma separated short names of committees, eg. os,so.", "schema": {"type": "string"}},
+          {"name": "q", "in": "query", "description": "Text that the title, location or a document title contains.", "schema": {"type": "string"}},
+          {"name": "page", "in": "query", "schema": {"type": "integer", "minimum": 1, "default": 1}},
+          {"name": "per_page", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 200, "default": 50}}
+        ],
+        "responses": {
+          "200": {"description": "A page of meetings.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MeetingList"}}}},
+          "400": {"description": "Invalid parameters.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "503": {"description": "The meetings of a municipality haven't been loaded yet, see Retry-After.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/meetings/{id}": {
+      "get": {
+        "summary": "Get a meeting",
+        "description": "Returns a single meeting, also when it is no longer in the window of the calendar feeds.",
+        "operationId": "getMeeting",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "description": "The id of the meeting, eg. leiden-247980.", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The meeting.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Meeting"}}}},
+          "404": {"description": "Unknown meeting.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "503": {"description": "The meeting wasn't found, but not every municipality has been loaded yet, see Retry-After.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "MeetingList": {
+        "type": "object",
+        "required": ["meetings", "page", "perPage", "total"],
+        "properties": {
+          "meetings": {"type": "array", "items": {"$ref": "#/components/schemas/Meeting"}},
+          "page": {"type": "integer"},
+          "perPage": {"type": "integer"},
+          "total": {"type": "integer", "description": "The number of meetings on all pages."},
+          "next": {"type": "string", "description": "The path of the next page, if there is one."}
+        }
+      },
+      "Meeting": {
+        "type": "object",
+        "required": ["id", "gemeente", "title", "start", "end", "allDay", "canceled", "removed", "documents", "revision", "updated", "links"],
+        "properties": {
+          "id": {"type": "string", "description": "Stable id, also the UID (before the @) in the calendar feeds."},
+          "gemeente": {"type": "string"},
+          "title": {"type": "string"},
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time", "description": "All-day meetings end at the start of the next day."},
+          "allDay": {"type": "boolean"},
+          "canceled": {"type": "boolean"},
+          "removed": {"type": "boolean", "description": "The meeting no longer exists in Notubiz. It is kept for the history, but not in the feeds."},
+          "location": {"type": "string"},
+          "committee": {"$ref": "#/components/schemas/Committee"},
+          "documents": {"type": "array", "items": {"$ref": "#/components/schemas/Document"}},
+          "revision": {"type": "integer", "description": "Increases every time the meeting changes."},
+          "updated": {"type": "string", "format": "date-time"},
+          "links": {"$ref": "#/components/schemas/Links"}
+        }
+      },
+      "Committee": {
+        "type": "object",
+        "required": ["short", "name"],
+        "properties": {
+          "short": {"type": "string"},
+          "name": {"type": "string"}
+        }
+      },
+      "Document": {
+        "type": "object",
+        "required": ["title", "url"],
+        "properties": {
+          "title": {"type": "string"},
+          "url": {"type": "string", "format": "uri"}
+        }
+      },
+      "Links": {
+        "type": "object",
+        "required": ["self", "calendar", "page"],
+        "properties": {
+          "self": {"type": "string"},
+          "calendar": {"type": "string", "description": "A calendar with only this meeting."},
+          "page": {"type": "string"},
+          "notubiz": {"type": "string", "format": "uri"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,81 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+type openAPISchema struct {
+	Required   []string               `json:"required"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+func TestOpenAPISpecShouldBeServed(t *testing.T) {
+	w := lookupRequest(openAPIHandler(), apiOpenAPIPath)
+
+	assert.Equal(t, http.StatusOK, w.Code, "Spec not served!")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "Wrong content type!")
+	assert.True(t, json.Valid(w.Body.Bytes()), "Spec is not valid JSON!")
+}
+
+// The documented schemas should have exactly the fields of the responses.
+func TestOpenAPISpecShouldMatchTheResponses(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas map[string]openAPISchema `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(openAPISpec), &spec), "Spec is not valid JSON!")
+
+	i := GetTestItem3()
+	i.ExtractedDocuments = []document{{Title: "Agenda", URL: "https://leiden.notubiz.nl/document/1"}}
+	m := newAPIMeeting(GetTestTenant(), i)
+
+	for name, v := range map[string]interface{}{
+		"MeetingList": apiMeetingList{Meetings: []apiMeeting{m}, Next: "/next"},
+		"Meeting":     m,
+		"Committee":   m.Committee,
+		"Document":    m.Documents[0],
+		"Links":       m.Links,
+		"Error":       apiError{"Eep!"},
+	} {
+		schema, ok := spec.Components.Schemas[name]
+		if !assert.True(t, ok, "Schema [%s] missing!", name) {
+			continue
+		}
+
+		b, _ := json.Marshal(v)
+		var fields map[string]interface{}
+		json.Unmarshal(b, &fields)
+
+		assert.Equal(t, keys(fields), keys(schema.Properties), "Fields of [%s] differ from the spec!", name)
+		for _, r := range schema.Required {
+			assert.Contains(t, fields, r, "Required field [%s] of [%s] missing!", r, name)
+		}
+	}
+}
+
+func keys(m map[string]interface{}) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// fingerprint captures the parts of an item that calendar clients show.
+func fingerprint(i CalItem) string {
+	return fmt.Sprintf("%t|%t|%t|%d|%d|%s|%s", i.Removed, i.Canceled, i.AllDay, i.StartDateTime.Unix(), i.EndDateTime.Unix(), i.Location, i.Description)
+}
+
+// revise fills in the sequence number and modification time of a freshly fetched item, based on
+// the previously stored version (if found). Calendar clients use these to detect that an event
+// has changed.
+func revise(prev CalItem, found bool, i CalItem, seen time.Time) CalItem {
+	switch {
+	case !found:
+		i.Sequence = 0
+		i.LastModified = seen.In(time.UTC)
+	case fingerprint(prev) != fingerprint(i):
+		i.Sequence = prev.Sequence + 1
+		i.LastModified = seen.In(time.UTC)
+	default:
+		i.Sequence = prev.Sequence
+		i.LastModified = prev.LastModified
+
+		// The DTSTAMP of an unchanged item stays the same, so the feed only changes when an item does
+		if !prev.CreatedDateTime.IsZero() {
+			i.CreatedDateTime = prev.CreatedDateTime
+		}
+	}
+
+	// Later changes to a cancelled item (eg. its documents) don't restart the cancellation grace period
+	switch {
+	case !i.Canceled && !i.Removed:
+		i.CanceledAt = time.Time{}
+	case found && (prev.Canceled || prev.Removed):
+		i.CanceledAt = canceledSince(prev)
+	default:
+		i.CanceledAt = seen.In(time.UTC)
+	}
+
+	return i
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRevisionsShouldTrackChanges(t *testing.T) {
+	poll1 := GetTestTime()
+	poll2 := poll1.Add(6 * time.Hour)
+	poll3 := poll2.Add(6 * time.Hour)
+
+	first := revise(CalItem{}, false, GetTestItem2(), poll1)
+	assert.Equal(t, 0, first.Sequence, "New item has wrong sequence!")
+	assert.Equal(t, poll1.In(time.UTC), first.LastModified, "New item has wrong modification time!")
+
+	again := GetTestItem2()
+	again.CreatedDateTime = poll2.In(time.UTC)
+	unchanged := revise(first, true, again, poll2)
+	assert.Equal(t, 0, unchanged.Sequence, "Unchanged item has wrong sequence!")
+	assert.Equal(t, poll1.In(time.UTC), unchanged.LastModified, "Unchanged item has wrong modification time!")
+	assert.Equal(t, first.CreatedDateTime, unchanged.CreatedDateTime, "Unchanged item has a new DTSTAMP!")
+
+	// The item is moved an hour
+	moved := GetTestItem2()
+	moved.StartDateTime = moved.StartDateTime.Add(time.Hour)
+	moved.EndDateTime = moved.EndDateTime.Add(time.Hour)
+
+	second := revise(unchanged, true, moved, poll2)
+	assert.Equal(t, 1, second.Sequence, "Moved item has wrong sequence!")
+	assert.Equal(t, poll2.In(time.UTC), second.LastModified, "Moved item has wrong modification time!")
+
+	// New documents don't count as a change, a new title and location do
+	docs := moved
+	docs.ExtractedDocuments = []document{{Title: "Agenda", URL: "https://leiden.notubiz.nl/agenda"}}
+	assert.Equal(t, 1, revise(second, true, docs, poll3).Sequence, "Item with new documents has wrong sequence!")
+
+	renamed := moved
+	renamed.Description = "Instructiebijeenkomst Raad071Cal (extra)"
+	renamed.Location = "Commissiekamer, Stadhuis, Leiden"
+	third := revise(second, true, renamed, poll3)
+	assert.Equal(t, 2, third.Sequence, "Renamed item has wrong sequence!")
+	assert.Equal(t, poll3.In(time.UTC), third.LastModified, "Renamed item has wrong modification time!")
+}
+
+func TestCancellingAnItemShouldIncreaseTheSequence(t *testing.T) {
+	first := revise(CalItem{}, false, GetTestItem2(), GetTestTime())
+
+	cancelled := GetTestItem2()
+	cancelled.Canceled = true
+	result := revise(first, true, cancelled, GetTestTime().Add(time.Hour))
+
+	assert.Equal(t, 1, result.Sequence, "Cancelled item has wrong sequence!")
+}
+
+func TestCancellationTimeShouldBeKeptUntilTheItemIsRestored(t *testing.T) {
+	first := revise(CalItem{}, false, GetTestItem2(), GetTestTime())
+	assert.True(t, first.CanceledAt.IsZero(), "Active item has a cancellation time!")
+
+	cancelled := GetTestItem2()
+	cancelled.Canceled = true
+	second := revise(first, true, cancelled, GetTestTime().Add(time.Hour))
+	assert.Equal(t, GetTestTime().Add(time.Hour).In(time.UTC), second.CanceledAt, "Wrong cancellation time!")
+
+	moved := cancelled
+	moved.Location = "Raadzaal"
+	third := revise(second, true, moved, GetTestTime().Add(2*time.Hour))
+	assert.Equal(t, second.CanceledAt, third.CanceledAt, "Cancellation time changed with the item!")
+
+	removed := moved
+	removed.Removed = true
+	fourth := revise(third, true, removed, GetTestTime().Add(3*time.Hour))
+	assert.Equal(t, second.CanceledAt, fourth.CanceledAt, "Cancellation time changed on removal!")
+
+	fifth := revise(fourth, true, GetTestItem2(), GetTestTime().Add(4*time.Hour))
+	assert.True(t, fifth.CanceledAt.IsZero(), "Restored item still has a cancellation time!")
+}
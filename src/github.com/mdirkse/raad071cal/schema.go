@@ -0,0 +1,264 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// JSON kinds of the fields in the schema
+const (
+	kindString  = "string"
+	kindNumber  = "number"
+	kindBoolean = "boolean"
+	kindArray   = "array"
+	kindObject  = "object"
+	kindNull    = "null"
+)
+
+// schemaField is a field of a Notubiz object as we know it.
+type schemaField struct {
+	kind     string
+	required bool
+}
+
+// The Notubiz calendar schema. Fields that are null are accepted for every kind.
+var (
+	envelopeSchema = map[string]schemaField{
+		"success":    {kindBoolean, true},
+		"request":    {kindString, false},
+		"message":    {kindString, false},
+		"error":      {kindString, false},
+		"meetings":   {kindArray, true},
+		"categories": {kindArray, false},
+	}
+	meetingSchema = map[string]schemaField{
+		"id":                {kindNumber, true},
+		"canceled":          {kindBoolean, true},
+		"description":       {kindString, true},
+		"confidential":      {kindNumber, false},
+		"location":          {kindString, true},
+		"long_description":  {kindString, false},
+		"short_description": {kindString, false},
+		"commissie":         {kindNumber, false},
+		"link":              {kindString, false},
+		"documents":         {kindArray, true},
+		"date":              {kindString, true},
+		"time":              {kindString, true},
+	}
+	documentSchema = map[string]schemaField{
+		"title":            {kindString, true},
+		"url":              {kindString, false}, // either url or document_url is required
+		"document_url":     {kindString, false},
+		"confidential":     {kindNumber, false},
+		"file_type":        {kindString, false},
+		"document_type":    {kindString, false},
+		"date":             {kindString, false},
+		"module_name":      {kindString, false},
+		"module_item_name": {kindString, false},
+		"module_item_url":  {kindString, false},
+	}
+	categorySchema = map[string]schemaField{
+		"id":    {kindNumber, true},
+		"short": {kindString, true},
+		"long":  {kindString, true},
+	}
+)
+
+// notubizMeeting is a meeting as Notubiz returns it, with only the fields we use (see meetingSchema
+// for all of them). It is turned into a CalItem before use.
+type notubizMeeting struct {
+	ID          int             `json:"id"`
+	Canceled    bool            `json:"canceled"`
+	Description string          `json:"description"`
+	Location    string          `json:"location"`
+	Committee   int             `json:"commissie"`
+	Link        string          `json:"link"`
+	Documents   json.RawMessage `json:"documents"`
+	Date        string          `json:"date"`
+	Time        string          `json:"time"`
+}
+
+// item returns the calendar item of the meeting, which still has to be enriched.
+func (m notubizMeeting) item() CalItem {
+	return CalItem{
+		ID:          m.ID,
+		Canceled:    m.Canceled,
+		Description: m.Description,
+		Location:    m.Location,
+		Link:        m.Link,
+		Documents:   m.Documents,
+		CommitteeID: m.Committee,
+		Date:        m.Date,
+		Time:        m.Time,
+	}
+}
+
+// notubizDocument is a document attached to a meeting. Older meetings use url, newer ones
+// (eg. motions) document_url.
+type notubizDocument struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	DocumentURL string `json:"document_url"`
+}
+
+// schemaDrift counts the differences between a response and the schema, per field (eg.
+// meeting.location).
+type schemaDrift struct {
+	Unknown    map[string]int `json:"unknown,omitempty"`
+	Missing    map[string]int `json:"missing,omitempty"`
+	Mismatched map[string]int `json:"mismatched,omitempty"` // field has another kind
+}
+
+func addCount(m *map[string]int, field string, n int) {
+	if *m == nil {
+		*m = make(map[string]int)
+	}
+	(*m)[field] += n
+}
+
+func (d *schemaDrift) merge(o schemaDrift) {
+	for f, n := range o.Unknown {
+		addCount(&d.Unknown, f, n)
+	}
+	for f, n := range o.Missing {
+		addCount(&d.Missing, f, n)
+	}
+	for f, n := range o.Mismatched {
+		addCount(&d.Mismatched, f, n)
+	}
+}
+
+func (d schemaDrift) empty() bool {
+	return len(d.Unknown) == 0 && len(d.Missing) == 0 && len(d.Mismatched) == 0
+}
+
+func (d schemaDrift) String() string {
+	var parts []string
+	for _, c := range []struct {
+		name   string
+		fields map[string]int
+	}{{"unknown", d.Unknown}, {"missing", d.Missing}, {"mismatched", d.Mismatched}} {
+		if len(c.fields) == 0 {
+			continue
+		}
+		var fields []string
+		for f, n := range c.fields {
+			fields = append(fields, fmt.Sprintf("%s (%dx)", f, n))
+		}
+		sort.Strings(fields)
+		parts = append(parts, c.name+": "+strings.Join(fields, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// detectDrift compares a calendar response with the schema.
+func detectDrift(payload []byte) schemaDrift {
+	var d schemaDrift
+
+	var env map[string]interface{}
+	if err := json.Unmarshal(payload, &env); err != nil {
+		addCount(&d.Mismatched, "envelope", 1)
+		return d
+	}
+	d.checkObject("envelope", env, envelopeSchema)
+
+	if meetings, ok := env["meetings"].([]interface{}); ok {
+		for _, m := range meetings {
+			mm, ok := m.(map[string]interface{})
+			if !ok {
+				addCount(&d.Mismatched, "meeting", 1)
+				continue
+			}
+			d.checkObject("meeting", mm, meetingSchema)
+			d.checkDocuments(mm["documents"])
+		}
+	}
+
+	if cats, ok := env["categories"].([]interface{}); ok {
+		for _, c := range cats {
+			cm, ok := c.(map[string]interface{})
+			if !ok {
+				addCount(&d.Mismatched, "category", 1)
+				continue
+			}
+			d.checkObject("category", cm, categorySchema)
+		}
+	}
+
+	return d
+}
+
+// checkDocuments checks a (nested) list of documents.
+func (d *schemaDrift) checkDocuments(docs interface{}) {
+	list, ok := docs.([]interface{})
+	if !ok {
+		return // already counted as a mismatch of the meeting
+	}
+
+	for _, doc := range list {
+		switch v := doc.(type) {
+		case []interface{}:
+			d.checkDocuments(v)
+		case map[string]interface{}:
+			d.checkObject("document", v, documentSchema)
+			_, url := v["url"]
+			_, docURL := v["document_url"]
+			if !url && !docURL {
+				addCount(&d.Missing, "document.url", 1)
+			}
+		default:
+			addCount(&d.Mismatched, "document", 1)
+		}
+	}
+}
+
+func (d *schemaDrift) checkObject(name string, o map[string]interface{}, schema map[string]schemaField) {
+	for f, v := range o {
+		sf, ok := schema[f]
+		if !ok {
+			addCount(&d.Unknown, name+"."+f, 1)
+			continue
+		}
+		if k := jsonKind(v); k != kindNull && k != sf.kind {
+			addCount(&d.Mismatched, name+"."+f, 1)
+		}
+	}
+
+	for f, sf := range schema {
+		if _, ok := o[f]; sf.required && !ok {
+			addCount(&d.Missing, name+"."+f, 1)
+		}
+	}
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return kindString
+	case float64:
+		return kindNumber
+	case bool:
+		return kindBoolean
+	case []interface{}:
+		return kindArray
+	case map[string]interface{}:
+		return kindObject
+	default:
+		return kindNull
+	}
+}
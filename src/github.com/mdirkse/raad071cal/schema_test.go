@@ -0,0 +1,92 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTestFilesShouldMatchTheSchema(t *testing.T) {
+	for _, f := range []string{"../../../../testfiles/tst.json", "../../../../testfiles/ghi-1.json"} {
+		payload, _ := ioutil.ReadFile(f)
+		d := detectDrift(payload)
+		assert.True(t, d.empty(), "Drift in [%s]: %s", f, d)
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	payload := `{"success": true, "page": 1, "meetings": [
+		{"id": "1", "canceled": false, "description": "Raad", "location": null, "date": "23-06-2016", "time": "20:00", "documents": [
+			{"title": "Agenda", "url": "https://example.com/a"},
+			[{"title": "Motie", "href": "https://example.com/b"}],
+			"https://example.com/c"
+		]},
+		{"id": 2, "canceled": false, "description": "Raad", "location": "", "date": "23-06-2016", "documents": [], "video": "x"}
+	], "categories": [{"id": 1, "short": "BZ"}]}`
+
+	d := detectDrift([]byte(payload))
+
+	assert.Equal(t, map[string]int{"envelope.page": 1, "meeting.video": 1, "document.href": 1}, d.Unknown, "Wrong unknown fields!")
+	assert.Equal(t, map[string]int{"meeting.time": 1, "document.url": 1, "category.long": 1}, d.Missing, "Wrong missing fields!")
+	assert.Equal(t, map[string]int{"meeting.id": 1, "document": 1}, d.Mismatched, "Wrong mismatched fields!")
+	assert.Equal(t, "unknown: document.href (1x), envelope.page (1x), meeting.video (1x); missing: category.long (1x), document.url (1x), meeting.time (1x); mismatched: document (1x), meeting.id (1x)", d.String(), "Wrong drift description!")
+}
+
+func TestPollStatusShouldAddUpDrift(t *testing.T) {
+	results := []monthResult{
+		{month: yearMonth{2016, 6}, drift: schemaDrift{Unknown: map[string]int{"meeting.video": 2}}},
+		{month: yearMonth{2016, 7}, drift: schemaDrift{Unknown: map[string]int{"meeting.video": 1}, Missing: map[string]int{"meeting.time": 1}}},
+		{month: yearMonth{2016, 8}},
+	}
+
+	ps := newPollStatus(GetTestTime(), results)
+
+	assert.Equal(t, map[string]int{"meeting.video": 3}, ps.Drift.Unknown, "Unknown fields not added up!")
+	assert.Equal(t, map[string]int{"meeting.time": 1}, ps.Drift.Missing, "Missing fields not added up!")
+	assert.Nil(t, ps.Drift.Mismatched, "Mismatched fields without drift!")
+}
+
+func TestMalformedDocumentsShouldBeSkipped(t *testing.T) {
+	i := deEnrich(GetTestItem1())
+	i.Documents = []byte(`[
+		{"title": "Agenda", "url": "https://example.com/a"},
+		{"title": 12, "url": "https://example.com/b"},
+		{"title": "Zonder URL"},
+		[{"title": "Motie", "document_url": "https://example.com/c"}, null, "x"],
+		42
+	]`)
+
+	result, err := EnrichItem(context.Background(), GetTestTenant(), i, GetTestTime())
+
+	assert.Nil(t, err, "Item with malformed documents was not enriched!")
+	assert.Equal(t, []document{
+		{Title: "Agenda", URL: "https://example.com/a"},
+		{Title: "Motie", URL: "https://example.com/c"},
+	}, result.ExtractedDocuments, "Wrong documents extracted!")
+
+	i.Documents = []byte(`{"title": "Agenda"}`)
+	result, err = EnrichItem(context.Background(), GetTestTenant(), i, GetTestTime())
+	assert.Nil(t, err, "Item with a malformed document list was not enriched!")
+	assert.Empty(t, result.ExtractedDocuments, "Documents extracted from a malformed list!")
+}
+
+func TestItemWithoutDescriptionShouldNotPanic(t *testing.T) {
+	i := deEnrich(GetTestItem1())
+	i.Description = ""
+
+	assert.NotPanics(t, func() { EnrichItem(context.Background(), GetTestTenant(), i, GetTestTime()) }, "Empty description panicked!")
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout is how long in-flight requests and polls get to finish after a SIGTERM.
+var shutdownTimeout = 25 * time.Second
+
+// serve serves HTTP on l until ctx is done, and then shuts down gracefully: no new connections
+// are accepted, in-flight requests are drained, polling is stopped and running polls are
+// cancelled (through stopPolls) and waited for, so that the store can be closed safely.
+func serve(ctx context.Context, srv *http.Server, l net.Listener, stopPolls context.CancelFunc, ts []*tenant) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errs:
+		stopPolls()
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	cronT.Stop()
+	stopPolls()
+
+	err := srv.Shutdown(shutdownCtx)
+	for _, t := range ts {
+		t.waitForRefresh(shutdownCtx)
+	}
+
+	if serveErr := <-errs; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	if err == nil {
+		err = shutdownCtx.Err()
+	}
+
+	return err
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownShouldDrainRequests(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+
+	started, release := make(chan bool), make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})}
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- serve(ctx, srv, l, func() {}, nil)
+	}()
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+
+	<-started
+	stop()
+
+	select {
+	case <-served:
+		t.Fatal("Server stopped before the request was done!")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, "done", <-body, "In-flight request was not finished!")
+	assert.Nil(t, <-served, "Unclean shutdown!")
+
+	_, err := http.Get("http://" + l.Addr().String() + "/")
+	assert.NotNil(t, err, "Server still accepts requests!")
+}
+
+func TestShutdownShouldCancelRunningPolls(t *testing.T) {
+	store = newMemoryStore()
+
+	tt, upstream := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		<-r.Context().Done()
+	})
+	defer upstream.Close()
+
+	pollCtx, stopPolls := context.WithCancel(context.Background())
+	tt.startRefresh(pollCtx)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	ctx, stop := context.WithCancel(context.Background())
+	stop()
+
+	start := time.Now()
+	err := serve(ctx, &http.Server{}, l, stopPolls, []*tenant{tt})
+
+	assert.Nil(t, err, "Unclean shutdown!")
+	assert.True(t, time.Since(start) < fetchTimeout, "Running poll was not cancelled!")
+	assert.False(t, tt.adminStatus().Refreshing, "Shutdown didn't wait for the running poll!")
+	assert.True(t, tt.pollStatus().Abandoned, "Cancelled poll did not finish!")
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+)
+
+// snapshot is the data of a feed at one point in time. It is never modified after it has been
+// published: a poll publishes a new one, and requests keep using the one they started with.
+type snapshot struct {
+	items     []CalItem // the items in the feed window, must not be modified
+	published time.Time
+}
+
+var emptySnapshot = &snapshot{}
+
+// snapshot returns the current data of the feed of the tenant.
+func (t *tenant) snapshot() *snapshot {
+	if s := t.current.Load(); s != nil {
+		return s
+	}
+	return emptySnapshot
+}
+
+// calItems returns the current set of items for this tenant.
+func (t *tenant) calItems() []CalItem {
+	return t.snapshot().items
+}
+
+// setCalItems publishes a new snapshot with the given items, which must not be modified anymore.
+func (t *tenant) setCalItems(items []CalItem) {
+	t.current.Store(&snapshot{items: items, published: time.Now()})
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotShouldBeEmptyBeforeTheFirstPublish(t *testing.T) {
+	tt := GetTestTenant()
+
+	assert.Empty(t, tt.calItems(), "New tenant has items!")
+
+	items := []CalItem{GetTestItem1()}
+	tt.setCalItems(items)
+	s := tt.snapshot()
+
+	tt.setCalItems(nil)
+	assert.Equal(t, items, s.items, "Published snapshot was modified!")
+	assert.Empty(t, tt.calItems(), "New snapshot was not published!")
+}
+
+// Run with -race: the feeds are requested continuously while polls publish new snapshots.
+func TestFeedsShouldBeConsistentDuringReloads(t *testing.T) {
+	store = newMemoryStore()
+
+	// Every poll returns a different number of meetings in the current month
+	var poll int32
+	now := time.Now().In(cestTz)
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		var meetings []string
+		if ym == (yearMonth{now.Year(), int(now.Month())}) {
+			for n := 0; n <= int(atomic.LoadInt32(&poll)); n++ {
+				meetings = append(meetings, fmt.Sprintf(`{"id": %d, "description": "Gemeenteraad %d", "location": "Raadzaal", "documents": [], "date": "%s", "time": "20:00"}`,
+					n+1, n, now.Format("02-01-2006")))
+			}
+		}
+		fmt.Fprintf(w, `callback_function({"success": true, "meetings": [%s]})`, strings.Join(meetings, ","))
+	})
+	defer srv.Close()
+	tt.markLoaded(time.Time{})
+
+	done := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			loadCalendarItems(context.Background(), tt)
+			atomic.AddInt32(&poll, 1)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < 25 || atomic.LoadInt32(&poll) < 3; r++ {
+				req, _ := http.NewRequest("GET", "/kalender/alles.ics", nil)
+				w := httptest.NewRecorder()
+				calHandler(tt).ServeHTTP(w, req)
+
+				body := w.Body.String()
+				if !assert.Equal(t, http.StatusOK, w.Code, "Feed not served!") ||
+					!assert.True(t, strings.HasSuffix(body, "END:VCALENDAR\r\n"), "Incomplete feed!") ||
+					!assert.Equal(t, strings.Count(body, "BEGIN:VEVENT"), strings.Count(body, "END:VEVENT"), "Incomplete events!") {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-polled
+
+	assert.Equal(t, int(atomic.LoadInt32(&poll)), len(tt.calItems()), "Last poll was not published!")
+}
+
+func TestStatusShouldBeReadableDuringReloads(t *testing.T) {
+	store = newMemoryStore()
+
+	tt, srv := newTestUpstream(func(w http.ResponseWriter, r *http.Request, ym yearMonth) {
+		io.WriteString(w, `callback_function({"success": true, "meetings": []})`)
+	})
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 5; n++ {
+			tt.refresh(context.Background())
+		}
+	}()
+
+	handlers := []http.Handler{statusHandler([]*tenant{tt}), adminStatusHandler([]*tenant{tt}), metricsHandler([]*tenant{tt}), readyzHandler([]*tenant{tt})}
+	for n := 0; n < 50; n++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		handlers[n%len(handlers)].ServeHTTP(httptest.NewRecorder(), req)
+	}
+	wg.Wait()
+}
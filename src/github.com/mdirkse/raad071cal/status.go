@@ -0,0 +1,116 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// monthStatus is the outcome of fetching one month during a poll.
+type monthStatus struct {
+	Month     string `json:"month"`
+	OK        bool   `json:"ok"`
+	Unchanged bool   `json:"unchanged,omitempty"`
+	Items     int    `json:"items"`
+	Reason    string `json:"reason,omitempty"` // kind of error, see errorReason
+	Error     string `json:"error,omitempty"`
+}
+
+// pollStatus describes the last poll of a tenant.
+type pollStatus struct {
+	ID        string        `json:"id"` // poll_id in the logs
+	Started   time.Time     `json:"started"`
+	Finished  time.Time     `json:"finished"`
+	Months    []monthStatus `json:"months"`
+	Failed    int           `json:"failed"`
+	Unchanged int           `json:"unchanged"`
+	Abandoned bool          `json:"abandoned"` // true if no month could be fetched
+	QueueWait queueWait     `json:"queueWait"`
+	Drift     schemaDrift   `json:"drift"` // differences with the Notubiz schema we know
+}
+
+// publicPollStatus is the part of the poll status that is shown to everyone: when the last poll
+// finished and which months failed, with the kind of error. Error messages, poll IDs and drift
+// are only shown at /admin/status.
+type publicPollStatus struct {
+	Finished time.Time           `json:"finished"`
+	Months   []publicMonthStatus `json:"months"`
+}
+
+type publicMonthStatus struct {
+	Month  string `json:"month"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func newPollStatus(started time.Time, results []monthResult) pollStatus {
+	ps := pollStatus{Started: started, Finished: time.Now(), Months: make([]monthStatus, len(results))}
+
+	for n, r := range results {
+		ms := monthStatus{Month: r.month.String(), OK: r.err == nil, Unchanged: r.unchanged, Items: len(r.items)}
+		if r.err != nil {
+			ms.Reason = errorReason(r.err)
+			ms.Error = r.err.Error()
+			ps.Failed++
+		}
+		if r.unchanged {
+			ps.Unchanged++
+		}
+		ps.Drift.merge(r.drift)
+		ps.Months[n] = ms
+	}
+
+	ps.Abandoned = len(results) > 0 && ps.Failed == len(results)
+
+	return ps
+}
+
+func (ps pollStatus) public() publicPollStatus {
+	pps := publicPollStatus{Finished: ps.Finished, Months: make([]publicMonthStatus, len(ps.Months))}
+	for n, ms := range ps.Months {
+		pps.Months[n] = publicMonthStatus{Month: ms.Month, OK: ms.OK, Reason: ms.Reason}
+	}
+	return pps
+}
+
+func (t *tenant) setPollStatus(ps pollStatus) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.status = ps
+}
+
+func (t *tenant) pollStatus() pollStatus {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.status
+}
+
+// statusHandler shows the public outcome of the last poll of every tenant.
+func statusHandler(ts []*tenant) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string]publicPollStatus, len(ts))
+		for _, t := range ts {
+			status[t.Name] = t.pollStatus().public()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			logger(r.Context()).Error("Unable to write the poll status", "err", err)
+		}
+	})
+}
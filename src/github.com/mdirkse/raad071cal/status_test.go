@@ -0,0 +1,76 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPollStatusShouldReflectMonthResults(t *testing.T) {
+	results := []monthResult{
+		{month: yearMonth{2016, 6}, items: []CalItem{GetTestItem1(), GetTestItem2()}},
+		{month: yearMonth{2016, 7}, err: errors.New("Eep!")},
+	}
+
+	ps := newPollStatus(GetTestTime(), results)
+
+	assert.Equal(t, []monthStatus{
+		{Month: "2016-06", OK: true, Items: 2},
+		{Month: "2016-07", OK: false, Reason: "other", Error: "Eep!"},
+	}, ps.Months, "Wrong month status!")
+	assert.Equal(t, 1, ps.Failed, "Wrong amount of failed months!")
+	assert.False(t, ps.Abandoned, "Partially failed poll was abandoned!")
+
+	assert.True(t, newPollStatus(GetTestTime(), results[1:]).Abandoned, "Failed poll was not abandoned!")
+}
+
+func TestStatusEndpointShouldShowAllTenants(t *testing.T) {
+	ts, _ := parseTenants("leiden,oegstgeest")
+	ts[0].setPollStatus(newPollStatus(GetTestTime(), []monthResult{{month: yearMonth{2016, 7}, err: errors.New("Eep!")}}))
+
+	req, _ := http.NewRequest("GET", "/status", nil)
+	w := httptest.NewRecorder()
+	statusHandler(ts).ServeHTTP(w, req)
+
+	var status map[string]publicPollStatus
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+
+	assert.Nil(t, err, "Status is not valid JSON!")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "Wrong content type!")
+	assert.Equal(t, 2, len(status), "Wrong amount of tenants!")
+	assert.Equal(t, []publicMonthStatus{{Month: "2016-07", OK: false, Reason: "other"}}, status["leiden"].Months, "Wrong month status!")
+	assert.Empty(t, status["oegstgeest"].Months, "Status of a tenant that wasn't polled has months!")
+}
+
+// The error messages and other internals of a poll are only for the admin.
+func TestStatusEndpointShouldOnlyShowWhetherMonthsFailed(t *testing.T) {
+	ts, _ := parseTenants("leiden")
+	ps := newPollStatus(GetTestTime(), []monthResult{{month: yearMonth{2016, 7}, err: errors.New("Eep!")}})
+	ps.ID = "42"
+	ts[0].setPollStatus(ps)
+
+	req, _ := http.NewRequest("GET", "/status", nil)
+	w := httptest.NewRecorder()
+	statusHandler(ts).ServeHTTP(w, req)
+
+	body := w.Body.String()
+	for _, hidden := range []string{"Eep!", `"id"`, `"drift"`, `"queueWait"`} {
+		assert.NotContains(t, body, hidden, "Status shows [%s]!", hidden)
+	}
+}
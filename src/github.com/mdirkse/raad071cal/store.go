@@ -0,0 +1,303 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store keeps every meeting that has ever been seen, per tenant.
+type Store interface {
+	// Replace stores the items that were fetched for the given months. Stored items in those
+	// months that were not fetched again no longer exist upstream and are marked as removed, so
+	// they stay in the history. The stored versions of the fetched items, with their revision
+	// filled in, are returned.
+	Replace(tenant string, months []yearMonth, items []CalItem, seen time.Time) ([]CalItem, error)
+	// Range returns the items of a tenant that start in [from, to), ordered by start time,
+	// including the removed ones.
+	Range(tenant string, from time.Time, to time.Time) ([]CalItem, error)
+	// Get returns the item of a tenant with the given UID, and whether it was found.
+	Get(tenant string, uid string) (CalItem, bool, error)
+	// Validators returns the validators of the stored months of a tenant.
+	Validators(tenant string) (map[yearMonth]monthValidator, error)
+	// SetValidators stores the validators of the given months of a tenant, next to the ones of
+	// the other months.
+	SetValidators(tenant string, validators map[yearMonth]monthValidator) error
+	Close() error
+}
+
+// storedItem is the format in which items are stored. It is independent of the Notubiz
+// response that CalItem is decoded from.
+type storedItem struct {
+	UID          string           `json:"uid"`
+	NotubizID    int              `json:"notubizId,omitempty"`
+	Sequence     int              `json:"sequence"`
+	LastModified time.Time        `json:"lastModified"`
+	Created      time.Time        `json:"created"`
+	AllDay       bool             `json:"allDay,omitempty"`
+	Canceled     bool             `json:"canceled,omitempty"`
+	Removed      bool             `json:"removed,omitempty"`
+	CanceledAt   *time.Time       `json:"canceledAt,omitempty"`
+	Title        string           `json:"title"`
+	Location     string           `json:"location,omitempty"`
+	Link         string           `json:"link,omitempty"`
+	Committee    *storedCommittee `json:"committee,omitempty"`
+	Documents    []storedDocument `json:"documents,omitempty"`
+	Start        time.Time        `json:"start"`
+	End          time.Time        `json:"end"`
+}
+
+type storedCommittee struct {
+	ID    int    `json:"id"`
+	Short string `json:"short"`
+	Name  string `json:"name"`
+}
+
+type storedDocument struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+func newStoredItem(i CalItem) storedItem {
+	s := storedItem{
+		UID:          i.UID,
+		NotubizID:    i.ID,
+		Sequence:     i.Sequence,
+		LastModified: i.LastModified,
+		Created:      i.CreatedDateTime,
+		AllDay:       i.AllDay,
+		Canceled:     i.Canceled,
+		Removed:      i.Removed,
+		Title:        i.Description,
+		Location:     i.Location,
+		Link:         i.Link,
+		Start:        i.StartDateTime,
+		End:          i.EndDateTime,
+	}
+
+	if !i.CanceledAt.IsZero() {
+		at := i.CanceledAt
+		s.CanceledAt = &at
+	}
+	if i.Committee.ID != 0 {
+		s.Committee = &storedCommittee{ID: i.Committee.ID, Short: i.Committee.Short, Name: i.Committee.Long}
+	}
+	for _, d := range i.ExtractedDocuments {
+		s.Documents = append(s.Documents, storedDocument{Title: d.Title, URL: d.URL})
+	}
+
+	return s
+}
+
+func (s storedItem) item() CalItem {
+	i := CalItem{
+		ID:                 s.NotubizID,
+		UID:                s.UID,
+		Sequence:           s.Sequence,
+		LastModified:       s.LastModified,
+		AllDay:             s.AllDay,
+		Canceled:           s.Canceled,
+		Removed:            s.Removed,
+		Description:        s.Title,
+		Location:           s.Location,
+		Link:               s.Link,
+		ExtractedDocuments: []document{},
+		CreatedDateTime:    s.Created,
+		StartDateTime:      s.Start,
+		EndDateTime:        s.End,
+	}
+
+	if s.CanceledAt != nil {
+		i.CanceledAt = *s.CanceledAt
+	}
+	if s.Committee != nil {
+		i.CommitteeID = s.Committee.ID
+		i.Committee = category{ID: s.Committee.ID, Short: s.Committee.Short, Long: s.Committee.Name}
+	}
+	for _, d := range s.Documents {
+		i.ExtractedDocuments = append(i.ExtractedDocuments, document{Title: d.Title, URL: d.URL})
+	}
+
+	return i
+}
+
+// mergeMonths works out how the stored items of a tenant change when the given months are
+// replaced by the fetched items: the fetched items with their revision filled in, and the
+// stored items that were not fetched again, now marked as removed. Both have to be written.
+// get looks up a stored item, inMonth returns the stored items of a month.
+func mergeMonths(months []yearMonth, items []CalItem, seen time.Time,
+	get func(uid string) (CalItem, bool, error), inMonth func(ym yearMonth) ([]CalItem, error)) ([]CalItem, []CalItem, error) {
+
+	fetched := make(map[string]bool, len(items))
+	put := make([]CalItem, len(items))
+	for n, i := range items {
+		prev, ok, err := get(i.UID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		put[n] = revise(prev, ok, i, seen)
+		fetched[i.UID] = true
+	}
+
+	var removed []CalItem
+	for _, ym := range months {
+		stored, err := inMonth(ym)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, i := range stored {
+			if fetched[i.UID] || i.Removed {
+				continue
+			}
+
+			r := i
+			r.Removed = true
+			removed = append(removed, revise(i, true, r, seen))
+		}
+	}
+
+	return put, removed, nil
+}
+
+// memoryStore is a Store that only keeps the items in memory, for when there's no data directory.
+type memoryStore struct {
+	mutex      sync.RWMutex
+	tenants    map[string]map[string]CalItem           // tenant -> UID -> item
+	validators map[string]map[yearMonth]monthValidator // tenant -> month -> validator
+}
+
+func newMemoryStore() Store {
+	return &memoryStore{
+		tenants:    make(map[string]map[string]CalItem),
+		validators: make(map[string]map[yearMonth]monthValidator),
+	}
+}
+
+func (s *memoryStore) Replace(tenant string, months []yearMonth, items []CalItem, seen time.Time) ([]CalItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored := s.tenants[tenant]
+	if stored == nil {
+		stored = make(map[string]CalItem)
+		s.tenants[tenant] = stored
+	}
+
+	put, removed, err := mergeMonths(months, items, seen,
+		func(uid string) (CalItem, bool, error) {
+			i, ok := stored[uid]
+			return i, ok, nil
+		},
+		func(ym yearMonth) ([]CalItem, error) {
+			var is []CalItem
+			for _, i := range stored {
+				if itemMonth(i) == ym {
+					is = append(is, i)
+				}
+			}
+			return is, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range append(removed, put...) {
+		stored[i.UID] = i
+	}
+
+	return put, nil
+}
+
+func (s *memoryStore) Range(tenant string, from time.Time, to time.Time) ([]CalItem, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	items := []CalItem{}
+	for _, i := range s.tenants[tenant] {
+		if !i.StartDateTime.Before(from) && i.StartDateTime.Before(to) {
+			items = append(items, i)
+		}
+	}
+
+	sortItems(items)
+
+	return items, nil
+}
+
+func (s *memoryStore) Get(tenant string, uid string) (CalItem, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	i, ok := s.tenants[tenant][uid]
+	return i, ok, nil
+}
+
+func (s *memoryStore) Validators(tenant string) (map[yearMonth]monthValidator, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	vs := make(map[yearMonth]monthValidator, len(s.validators[tenant]))
+	for ym, v := range s.validators[tenant] {
+		vs[ym] = v
+	}
+	return vs, nil
+}
+
+func (s *memoryStore) SetValidators(tenant string, validators map[yearMonth]monthValidator) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored := s.validators[tenant]
+	if stored == nil {
+		stored = make(map[yearMonth]monthValidator)
+		s.validators[tenant] = stored
+	}
+	for ym, v := range validators {
+		stored[ym] = v
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// itemMonth returns the month in which the item takes place, as Notubiz sees it.
+func itemMonth(i CalItem) yearMonth {
+	st := i.StartDateTime
+	if !i.AllDay {
+		st = st.In(cestTz)
+	}
+	return yearMonth{year: st.Year(), month: int(st.Month())}
+}
+
+// monthRange returns the period in which the items of a month start. All-day items start at
+// midnight UTC, which is always within the month in Amsterdam.
+func monthRange(ym yearMonth) (time.Time, time.Time) {
+	som := time.Date(ym.year, time.Month(ym.month), 1, 0, 0, 0, 0, cestTz)
+	return som, som.AddDate(0, 1, 0)
+}
+
+func sortItems(items []CalItem) {
+	sort.Slice(items, func(a, b int) bool {
+		if items[a].StartDateTime.Equal(items[b].StartDateTime) {
+			return items[a].UID < items[b].UID
+		}
+		return items[a].StartDateTime.Before(items[b].StartDateTime)
+	})
+}
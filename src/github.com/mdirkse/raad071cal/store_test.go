@@ -0,0 +1,225 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	testMonth     = yearMonth{2016, 6}
+	testMonthNext = yearMonth{2016, 7}
+)
+
+// getTestNextMonthItem returns an item that takes place a month after the other test items.
+func getTestNextMonthItem() CalItem {
+	i := GetTestItem3()
+	i.ID = 250000
+	i.UID = "leiden-250000"
+	i.StartDateTime = i.StartDateTime.AddDate(0, 1, 0)
+	i.EndDateTime = i.EndDateTime.AddDate(0, 1, 0)
+	return i
+}
+
+func getAllTime() (time.Time, time.Time) {
+	return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// forEachStore runs a test against every Store implementation.
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := openBoltStore(t.TempDir())
+		if !assert.Nil(t, err, "Unable to open store!") {
+			return
+		}
+		defer s.Close()
+		test(t, s)
+	})
+}
+
+func TestStoreShouldReplaceOnlyTheFetchedMonths(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		from, to := getAllTime()
+		next := getTestNextMonthItem()
+
+		_, err := s.Replace("leiden", []yearMonth{testMonth, testMonthNext}, []CalItem{GetTestItem3(), GetTestItem1(), next, GetTestItem2()}, GetTestTime())
+		assert.Nil(t, err, "Unable to store items!")
+
+		items, _ := s.Range("leiden", from, to)
+		assert.Equal(t, []string{"leiden-247977", "leiden-247981", "leiden-247980", "leiden-250000"}, getUIDs(items), "Items not stored in order!")
+
+		// Item 2 is removed upstream, the next month isn't fetched this time
+		_, err = s.Replace("leiden", []yearMonth{testMonth}, []CalItem{GetTestItem1(), GetTestItem3()}, GetTestTime())
+		assert.Nil(t, err, "Unable to store items!")
+
+		items, _ = s.Range("leiden", from, to)
+		assert.Equal(t, []string{"leiden-247977", "leiden-247981", "leiden-247980", "leiden-250000"}, getUIDs(items), "Removed item not kept!")
+		assert.Equal(t, []string{"leiden-247977", "leiden-247980", "leiden-250000"}, getUIDs(dropRemoved(items)), "Wrong items replaced!")
+
+		removed, _, _ := s.Get("leiden", "leiden-247981")
+		assert.True(t, removed.Removed, "Item not marked as removed!")
+		assert.Equal(t, 1, removed.Sequence, "Removed item was not revised!")
+
+		// Staying away doesn't revise the removed item again
+		s.Replace("leiden", []yearMonth{testMonth}, []CalItem{GetTestItem1(), GetTestItem3()}, GetTestTime().Add(time.Hour))
+		removed, _, _ = s.Get("leiden", "leiden-247981")
+		assert.Equal(t, 1, removed.Sequence, "Removed item was revised again!")
+
+		// and coming back makes it a normal item again
+		back, _ := s.Replace("leiden", []yearMonth{testMonth}, []CalItem{GetTestItem2()}, GetTestTime().Add(2*time.Hour))
+		assert.False(t, back[0].Removed, "Item is still removed!")
+		assert.Equal(t, 2, back[0].Sequence, "Returning item was not revised!")
+
+		other, _ := s.Range("leiderdorp", from, to)
+		assert.Empty(t, other, "Items leaked to another tenant!")
+	})
+}
+
+func TestStoreShouldReviseChangedItems(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Replace("leiden", []yearMonth{testMonth}, []CalItem{GetTestItem2()}, GetTestTime())
+
+		moved := GetTestItem2()
+		moved.StartDateTime = moved.StartDateTime.Add(time.Hour)
+		result, _ := s.Replace("leiden", []yearMonth{testMonth}, []CalItem{moved}, GetTestTime().Add(time.Hour))
+
+		assert.Equal(t, 1, result[0].Sequence, "Moved item was not revised!")
+	})
+}
+
+func TestStoreShouldOnlyReturnItemsInRange(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Replace("leiden", []yearMonth{testMonth, testMonthNext}, []CalItem{GetTestItem2(), getTestNextMonthItem()}, GetTestTime())
+
+		items, _ := s.Range("leiden", time.Date(2016, 7, 1, 0, 0, 0, 0, cestTz), time.Date(2016, 8, 1, 0, 0, 0, 0, cestTz))
+		assert.Equal(t, []string{"leiden-250000"}, getUIDs(items), "Wrong items in range!")
+	})
+}
+
+func TestBoltStoreShouldSurviveARestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raad071cal")
+	defer os.RemoveAll(dir)
+	from, to := getAllTime()
+
+	s, err := openBoltStore(dir)
+	assert.Nil(t, err, "Unable to open store!")
+	cancelled := GetTestItem2()
+	cancelled.Canceled = true
+	stored, err := s.Replace("leiden", []yearMonth{testMonth}, []CalItem{GetTestItem1(), cancelled}, GetTestTime())
+	assert.Nil(t, err, "Unable to store items!")
+	s.Close()
+
+	reopened, err := openBoltStore(dir)
+	assert.Nil(t, err, "Unable to reopen store!")
+
+	items, _ := reopened.Range("leiden", from, to)
+	if assert.Equal(t, 2, len(items), "Items were lost!") {
+		for n := range items {
+			assert.True(t, stored[n].StartDateTime.Equal(items[n].StartDateTime), "Start time changed!")
+			assert.True(t, stored[n].LastModified.Equal(items[n].LastModified), "Modification time changed!")
+			assert.True(t, stored[n].CanceledAt.Equal(items[n].CanceledAt), "Cancellation time changed!")
+			assert.Equal(t, stored[n].ExtractedDocuments, items[n].ExtractedDocuments, "Documents changed!")
+			assert.Equal(t, stored[n].Committee, items[n].Committee, "Committee changed!")
+		}
+	}
+
+	leftovers, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 1, len(leftovers), "Temporary files were left behind!")
+}
+
+func TestStoreShouldKeepValidatorsPerMonth(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		first := monthValidator{ETag: `"a"`, Hash: "x"}
+		next := monthValidator{LastModified: "Wed, 22 Jun 2016 10:00:00 GMT", Hash: "y"}
+
+		assert.Nil(t, s.SetValidators("leiden", map[yearMonth]monthValidator{testMonth: first, testMonthNext: first}), "Unable to store validators!")
+		assert.Nil(t, s.SetValidators("leiden", map[yearMonth]monthValidator{testMonthNext: next}), "Unable to store validators!")
+
+		vs, err := s.Validators("leiden")
+		assert.Nil(t, err, "Unable to read validators!")
+		assert.Equal(t, map[yearMonth]monthValidator{testMonth: first, testMonthNext: next}, vs, "Wrong validators!")
+
+		other, _ := s.Validators("leiderdorp")
+		assert.Empty(t, other, "Validators leaked to another tenant!")
+	})
+}
+
+func TestBoltStoreShouldKeepValidatorsAfterARestart(t *testing.T) {
+	dir := t.TempDir()
+	v := monthValidator{ETag: `"a"`, LastModified: "Wed, 22 Jun 2016 10:00:00 GMT", Hash: "x"}
+
+	s, _ := openBoltStore(dir)
+	s.SetValidators("leiden", map[yearMonth]monthValidator{testMonth: v})
+	s.Close()
+
+	reopened, _ := openBoltStore(dir)
+	defer reopened.Close()
+
+	vs, err := reopened.Validators("leiden")
+	assert.Nil(t, err, "Unable to read validators!")
+	assert.Equal(t, map[yearMonth]monthValidator{testMonth: v}, vs, "Validators were lost!")
+}
+
+func TestBoltStoreShouldBeLockedByOneProcess(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := openBoltStore(dir)
+	assert.Nil(t, err, "Unable to open store!")
+	defer s.Close()
+
+	_, err = openBoltStore(dir)
+	if assert.NotNil(t, err, "Store opened twice!") {
+		assert.Contains(t, err.Error(), "in use by another process", "Unclear error!")
+	}
+}
+
+func TestBoltStoreShouldMoveItemsInTheStartIndex(t *testing.T) {
+	s, _ := openBoltStore(t.TempDir())
+	defer s.Close()
+
+	s.Replace("leiden", []yearMonth{testMonth}, []CalItem{GetTestItem2()}, GetTestTime())
+	moved := GetTestItem2()
+	moved.StartDateTime = moved.StartDateTime.AddDate(0, 1, 0)
+	moved.EndDateTime = moved.EndDateTime.AddDate(0, 1, 0)
+	s.Replace("leiden", []yearMonth{testMonthNext}, []CalItem{moved}, GetTestTime())
+
+	from, to := monthRange(testMonth)
+	old, _ := s.Range("leiden", from, to)
+	assert.Empty(t, old, "Moved item still in its old month!")
+	from, to = monthRange(testMonthNext)
+	next, _ := s.Range("leiden", from, to)
+	assert.Equal(t, []string{"leiden-247981"}, getUIDs(next), "Moved item not in its new month!")
+}
+
+func TestFeedWindowShouldCoverWholeMonths(t *testing.T) {
+	from, to := feedWindow(GetTestTime())
+
+	assert.Equal(t, time.Date(2016, 1, 1, 0, 0, 0, 0, cestTz), from, "Wrong start of feed window!")
+	assert.Equal(t, time.Date(2017, 7, 1, 0, 0, 0, 0, cestTz), to, "Wrong end of feed window!")
+}
+
+func getUIDs(items []CalItem) []string {
+	var uids []string
+	for _, i := range items {
+		uids = append(uids, i.UID)
+	}
+	return uids
+}
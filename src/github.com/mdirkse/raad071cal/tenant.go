@@ -0,0 +1,170 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTenant   = "leiden"
+	defaultPollSpec = "1 1 */6 * * *"
+)
+
+// feedURLPrefix is the public URL under which the feeds are served.
+var feedURLPrefix = "http://raad071.mdirkse.nl/kalender"
+
+// Tenant names end up in host names, routes and file names, so they are kept simple.
+var validTenantName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// knownTenants holds the calendar metadata for the Notubiz tenants in the region.
+// Polls are staggered so that the tenants don't all hit Notubiz at the same time.
+var knownTenants = map[string]tenantInfo{
+	"leiden": {
+		Name:     "leiden",
+		Host:     "leiden.notubiz.nl",
+		CalName:  "#raad071 kalender",
+		CalDesc:  "De politieke agenda van de Leidse gemeenteraad",
+		TownHall: "Stadhuis, Leiden",
+		PollSpec: defaultPollSpec,
+	},
+	"leiderdorp": {
+		Name:     "leiderdorp",
+		Host:     "leiderdorp.notubiz.nl",
+		CalName:  "#raad071 kalender - Leiderdorp",
+		CalDesc:  "De politieke agenda van de gemeenteraad van Leiderdorp",
+		TownHall: "Gemeentehuis, Leiderdorp",
+		PollSpec: "1 11 */6 * * *",
+	},
+	"oegstgeest": {
+		Name:     "oegstgeest",
+		Host:     "oegstgeest.notubiz.nl",
+		CalName:  "#raad071 kalender - Oegstgeest",
+		CalDesc:  "De politieke agenda van de gemeenteraad van Oegstgeest",
+		TownHall: "Gemeentehuis, Oegstgeest",
+		PollSpec: "1 21 */6 * * *",
+	},
+	"zoeterwoude": {
+		Name:     "zoeterwoude",
+		Host:     "zoeterwoude.notubiz.nl",
+		CalName:  "#raad071 kalender - Zoeterwoude",
+		CalDesc:  "De politieke agenda van de gemeenteraad van Zoeterwoude",
+		TownHall: "Gemeentehuis, Zoeterwoude",
+		PollSpec: "1 31 */6 * * *",
+	},
+}
+
+// tenantInfo holds the static metadata of a tenant.
+type tenantInfo struct {
+	Name     string `yaml:"-"`                  // Used in the feed URL: /kalender/{Name}/alles.ics
+	Host     string `yaml:"host"`               // The Notubiz host, eg. leiden.notubiz.nl
+	APIBase  string `yaml:"api_base,omitempty"` // Overrides https://{Host} for the API requests
+	CalName  string `yaml:"cal_name"`
+	CalDesc  string `yaml:"cal_desc"`
+	TownHall string `yaml:"town_hall"` // Appended to the council's own meeting rooms
+	PollSpec string `yaml:"poll_spec"`
+}
+
+// tenant is a single Notubiz installation (ie. a municipality) for which we serve a calendar.
+type tenant struct {
+	tenantInfo
+
+	current     atomic.Pointer[snapshot] // the data of the feed, see snapshot
+	feeds       feedCache                // rendered variants of the current snapshot
+	status      pollStatus
+	queue       queueWait                    // waits since the last poll status
+	validators  map[yearMonth]monthValidator // of the months that were stored
+	refreshing  chan struct{}                // closed when the running poll is done
+	lastError   string
+	lastErrorAt time.Time
+	loaded      bool      // the feed has data, from a poll or the store
+	lastSuccess time.Time // of the last successful poll
+	mutex       sync.RWMutex
+}
+
+// newTenant returns the tenant with the given name. Tenants that we don't have metadata
+// for get sensible defaults derived from the name.
+func newTenant(name string) *tenant {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if ti, ok := knownTenants[name]; ok {
+		return &tenant{tenantInfo: ti}
+	}
+
+	m := strings.Title(name)
+	return &tenant{tenantInfo: tenantInfo{
+		Name:     name,
+		Host:     fmt.Sprintf("%s.notubiz.nl", name),
+		CalName:  fmt.Sprintf("#raad071 kalender - %s", m),
+		CalDesc:  fmt.Sprintf("De politieke agenda van de gemeenteraad van %s", m),
+		TownHall: fmt.Sprintf("Gemeentehuis, %s", m),
+		PollSpec: defaultPollSpec,
+	}}
+}
+
+// parseTenants turns a comma separated list of tenant names into tenants.
+func parseTenants(names string) ([]*tenant, error) {
+	var ts []*tenant
+	seen := make(map[string]bool)
+
+	for _, n := range strings.Split(names, ",") {
+		t := newTenant(n)
+		if t.Name == "" {
+			continue
+		}
+		if !validTenantName.MatchString(t.Name) {
+			return nil, fmt.Errorf("Invalid tenant name [%s]! Only letters, digits and dashes are allowed.", t.Name)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("Tenant [%s] was specified more than once!", t.Name)
+		}
+		seen[t.Name] = true
+		ts = append(ts, t)
+	}
+
+	if len(ts) == 0 {
+		return nil, fmt.Errorf("No tenants found in [%s]!", names)
+	}
+
+	return ts, nil
+}
+
+func (t *tenant) linkPrefix() string {
+	return "https://" + t.Host
+}
+
+func (t *tenant) calendarURL(ym yearMonth) string {
+	base := t.APIBase
+	if base == "" {
+		base = t.linkPrefix()
+	}
+	return fmt.Sprintf("%s/api/calendar/callback_function?year=%d&month=%d&callback=raad071cal", base, ym.year, ym.month)
+}
+
+func (t *tenant) feedURL() string {
+	return fmt.Sprintf("%s/%s/alles.ics", feedURLPrefix, t.Name)
+}
+
+func (t *tenant) feed() feed {
+	return feed{
+		URL:         t.feedURL(),
+		Name:        t.CalName,
+		Description: t.CalDesc,
+	}
+}
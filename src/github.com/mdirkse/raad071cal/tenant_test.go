@@ -0,0 +1,57 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseTenantsShouldYieldKnownAndUnknownTenants(t *testing.T) {
+	ts, err := parseTenants("leiden, Leiderdorp,katwijk")
+
+	assert.Nil(t, err, "Unable to parse tenant list!")
+	assert.Equal(t, 3, len(ts), "Wrong amount of tenants parsed!")
+
+	assert.Equal(t, "leiderdorp.notubiz.nl", ts[1].Host, "Known tenant has wrong host!")
+	assert.Equal(t, "Gemeentehuis, Leiderdorp", ts[1].TownHall, "Known tenant has wrong town hall!")
+
+	assert.Equal(t, "katwijk", ts[2].Name, "Unknown tenant has wrong name!")
+	assert.Equal(t, "https://katwijk.notubiz.nl", ts[2].linkPrefix(), "Unknown tenant has wrong link prefix!")
+	assert.Equal(t, defaultPollSpec, ts[2].PollSpec, "Unknown tenant has wrong poll schedule!")
+}
+
+func TestParseTenantsShouldRejectInvalidLists(t *testing.T) {
+	for _, l := range []string{"", " , ", "leiden,leiden", "../etc", "leiden.nl", "den haag", "a/b", "léiden"} {
+		_, err := parseTenants(l)
+		assert.NotNil(t, err, "Invalid tenant list [%s] was accepted!", l)
+	}
+}
+
+func TestTenantsShouldKeepTheirOwnItems(t *testing.T) {
+	ts, _ := parseTenants("leiden,oegstgeest")
+	ts[0].setCalItems([]CalItem{GetTestItem1()})
+
+	assert.Equal(t, 1, len(ts[0].calItems()), "Tenant has wrong amount of items!")
+	assert.Equal(t, 0, len(ts[1].calItems()), "Items leaked to another tenant!")
+}
+
+func TestCalendarHeaderShouldContainTenantMetadata(t *testing.T) {
+	var b bytes.Buffer
+	renderCalendar(newTenant("zoeterwoude").feed(), nil, &b)
+
+	assert.Contains(t, b.String(), "URL:http://raad071.mdirkse.nl/kalender/zoeterwoude/alles.ics\r\n", "Header has wrong URL!")
+	assert.Contains(t, b.String(), "X-WR-CALNAME:#raad071 kalender - Zoeterwoude\r\n", "Header has wrong name!")
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// tzTransition is a change of UTC offset in a timezone.
+type tzTransition struct {
+	at   time.Time
+	from int // offset in seconds east of UTC
+	to   int
+	name string
+}
+
+// zoneTransitions returns the transitions of loc between from and to, preceded by the transition
+// that was in effect at from (if there was one in the year before).
+func zoneTransitions(loc *time.Location, from time.Time, to time.Time) []tzTransition {
+	var ts []tzTransition
+	var active *tzTransition
+
+	t := from.AddDate(-1, 0, 0)
+	_, prev := t.In(loc).Zone()
+
+	for t.Before(to) {
+		next := t.Add(24 * time.Hour)
+
+		if _, off := next.In(loc).Zone(); off != prev {
+			at := findTransition(loc, t, next, prev)
+			name, _ := at.In(loc).Zone()
+			tr := tzTransition{at: at, from: prev, to: off, name: name}
+
+			if at.After(from) {
+				ts = append(ts, tr)
+			} else {
+				active = &tr
+			}
+
+			prev = off
+		}
+
+		t = next
+	}
+
+	if active != nil {
+		ts = append([]tzTransition{*active}, ts...)
+	}
+
+	return ts
+}
+
+// findTransition finds the exact second between lo and hi at which the offset changes from off.
+func findTransition(loc *time.Location, lo time.Time, hi time.Time, off int) time.Time {
+	for hi.Sub(lo) > time.Second {
+		mid := lo.Add(hi.Sub(lo) / 2).Truncate(time.Second)
+		if _, o := mid.In(loc).Zone(); o == off {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return hi
+}
+
+// vtimezone generates a VTIMEZONE component for loc that covers the period between from and to.
+// Every transition gets its own observance, so no recurrence rules are needed.
+func vtimezone(loc *time.Location, from time.Time, to time.Time) icalComponent {
+	tz := icalComponent{Name: "VTIMEZONE"}
+	tz.add(textProp("TZID", loc.String()))
+
+	ts := zoneTransitions(loc, from, to)
+
+	if len(ts) == 0 || ts[0].at.After(from) {
+		// No transition (in the last year) before the start of the range, so describe the offset
+		// that was in effect at that time as an observance that started long ago.
+		name, off := from.In(loc).Zone()
+		tz.Components = append(tz.Components, observance("STANDARD", time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), off, off, name))
+	}
+
+	for _, t := range ts {
+		kind := "STANDARD"
+		if t.to > t.from {
+			kind = "DAYLIGHT"
+		}
+
+		// DTSTART is the local time at which the transition happened, in the old offset
+		local := t.at.In(time.UTC).Add(time.Duration(t.from) * time.Second)
+		tz.Components = append(tz.Components, observance(kind, local, t.from, t.to, t.name))
+	}
+
+	return tz
+}
+
+func observance(kind string, local time.Time, from int, to int, name string) icalComponent {
+	o := icalComponent{Name: kind}
+
+	o.add(icalProperty{Name: "DTSTART", Type: icalDateTime, Value: local.Format(icalLocalLayout)})
+	o.add(icalProperty{Name: "TZOFFSETFROM", Type: icalOffset, Value: formatUTCOffset(from)})
+	o.add(icalProperty{Name: "TZOFFSETTO", Type: icalOffset, Value: formatUTCOffset(to)})
+	o.add(textProp("TZNAME", name))
+
+	return o
+}
+
+func formatUTCOffset(seconds int) string {
+	sign := '+'
+	if seconds < 0 {
+		sign = '-'
+		seconds = -seconds
+	}
+
+	if s := seconds % 60; s != 0 {
+		return fmt.Sprintf("%c%02d%02d%02d", sign, seconds/3600, seconds/60%60, s)
+	}
+
+	return fmt.Sprintf("%c%02d%02d", sign, seconds/3600, seconds/60%60)
+}
+
+// localProp renders a DATE-TIME as local time in loc, referring to the VTIMEZONE with a TZID.
+func localProp(name string, t time.Time, loc *time.Location) icalProperty {
+	return icalProperty{
+		Name:   name,
+		Params: []icalParam{{"TZID", []string{loc.String()}}},
+		Type:   icalDateTime,
+		Value:  t.In(loc).Format(icalLocalLayout),
+	}
+}
+
+// timedRange returns the period covered by the items that have a start time.
+func timedRange(items []CalItem) (time.Time, time.Time, bool) {
+	var from, to time.Time
+	found := false
+
+	for _, i := range items {
+		if i.AllDay {
+			continue
+		}
+		if !found || i.StartDateTime.Before(from) {
+			from = i.StartDateTime
+		}
+		if !found || i.EndDateTime.After(to) {
+			to = i.EndDateTime
+		}
+		found = true
+	}
+
+	return from, to, found
+}
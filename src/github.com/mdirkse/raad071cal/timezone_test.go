@@ -0,0 +1,77 @@
+// Copyright 2016 Maarten Dirkse
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestVTimezoneShouldCoverAllTransitionsInRange(t *testing.T) {
+	from := time.Date(2016, time.January, 10, 12, 0, 0, 0, time.UTC)
+	to := time.Date(2016, time.December, 1, 12, 0, 0, 0, time.UTC)
+
+	var result bytes.Buffer
+	vtimezone(cestTz, from, to).encode(&result)
+
+	expected := crlf(`BEGIN:VTIMEZONE
+TZID:Europe/Amsterdam
+BEGIN:STANDARD
+DTSTART:20151025T030000
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+TZNAME:CET
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:20160327T020000
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+TZNAME:CEST
+END:DAYLIGHT
+BEGIN:STANDARD
+DTSTART:20161030T030000
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+TZNAME:CET
+END:STANDARD
+END:VTIMEZONE`)
+
+	assert.Equal(t, expected, result.String(), "Timezone incorrectly rendered!")
+}
+
+func TestVTimezoneWithoutTransitionsShouldHaveOneObservance(t *testing.T) {
+	from := time.Date(2016, time.January, 10, 12, 0, 0, 0, time.UTC)
+	tz := vtimezone(time.UTC, from, from.AddDate(0, 1, 0))
+
+	assert.Equal(t, 1, len(tz.Components), "Wrong amount of observances!")
+	assert.Equal(t, "+0000", tz.Components[0].Properties[1].Value, "Wrong offset!")
+}
+
+func TestFormatUTCOffset(t *testing.T) {
+	assert.Equal(t, "+0100", formatUTCOffset(3600))
+	assert.Equal(t, "-0530", formatUTCOffset(-19800))
+	assert.Equal(t, "+001932", formatUTCOffset(1172)) // Amsterdam mean time
+}
+
+func TestTimedRangeShouldIgnoreAllDayItems(t *testing.T) {
+	_, _, ok := timedRange([]CalItem{GetTestItem1()})
+	assert.False(t, ok, "All day item resulted in a range!")
+
+	from, to, ok := timedRange([]CalItem{GetTestItem3(), GetTestItem1(), GetTestItem2()})
+	assert.True(t, ok, "No range found!")
+	assert.Equal(t, GetTestItem2().StartDateTime, from, "Wrong start of range!")
+	assert.Equal(t, GetTestItem3().EndDateTime, to, "Wrong end of range!")
+}
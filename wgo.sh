@@ -7,6 +7,7 @@ docker run --rm \
            -u "$(id -u):$(id -g)" \
            -e "CGO_ENABLED=0" \
            -e "GOOS=linux" \
+           -e "GO111MODULE=off" \
            -e "GOBIN=${projectnamedir}/build" \
            -e "GOPATH=${projectnamedir}:${projectnamedir}/vendor" \
            -e "PKGDIR=${projectnamedir}/build/pkg" \
@@ -14,5 +15,5 @@ docker run --rm \
            -w "${projectnamedir}" \
            --net=none \
            --log-driver=none \
-           golang:1.13.6-alpine3.11 \
+           golang:1.21.13-alpine3.20 \
            go "$@"